@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"github.com/canonical-ledgers/fblock-scan/log"
+)
+
+const dbUsage = `Usage: fblock-scan db <command> [flags]
+
+Commands:
+  migrate    Apply any pending schema migrations
+  backup     Write a consistent copy or snapshot of a live database
+  compress   Compress, or decompress, the data of all saved blocks
+`
+
+// dbCommand runs a "db" subcommand, which operates on the database without
+// starting the engine, and returns the exit code.
+func dbCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, dbUsage)
+		return 2
+	}
+	switch args[0] {
+	case "migrate":
+		return dbMigrate(args[1:])
+	case "backup":
+		return dbBackup(args[1:])
+	case "compress":
+		return dbCompress(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown db command: %q\n\n%v", args[0], dbUsage)
+	return 2
+}
+
+func dbMigrate(args []string) int {
+	flags := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	dbURI := flags.String("db", defaultDBURI(), "SQLite Database URI")
+	dryRun := flags.Bool("dry-run", false, "Print the pending migrations without applying them")
+	noBackup := flags.Bool("no-backup", false, "Do not back up the database before migrating")
+	flags.Parse(args)
+
+	lg := log.New(os.Stderr, log.FormatLogfmt, log.LevelInfo)
+
+	// Never create a new database.
+	openFlags := sqlite.SQLITE_OPEN_READWRITE
+	if *dryRun {
+		openFlags = sqlite.SQLITE_OPEN_READONLY
+	}
+	conn, err := sqlite.OpenConn(*dbURI,
+		openFlags|sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX)
+	if err != nil {
+		lg.Error("failed to open database", "db", *dbURI, "err", err)
+		return 1
+	}
+	defer conn.Close()
+
+	pending, err := db.PendingMigrations(conn)
+	if err != nil {
+		lg.Error("failed to plan migrations", "err", err)
+		return 1
+	}
+	if len(pending) == 0 {
+		fmt.Println("database is up to date")
+		return 0
+	}
+	for _, m := range pending {
+		fmt.Println(m)
+	}
+	if *dryRun {
+		return 0
+	}
+
+	if err := db.Migrate(conn, lg, !*noBackup); err != nil {
+		lg.Error("migration failed", "err", err)
+		return 1
+	}
+	lg.Info("migration complete", "version", pending[len(pending)-1].To)
+	return 0
+}
+
+func dbBackup(args []string) int {
+	flags := flag.NewFlagSet("db backup", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(),
+			"Usage: fblock-scan db backup [flags] <path>")
+		flags.PrintDefaults()
+	}
+	dbURI := flags.String("db", defaultDBURI(), "SQLite Database URI")
+	snapshot := flags.Bool("snapshot", false, "Write a compressed snapshot with a manifest, instead of a plain copy")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	path := flags.Arg(0)
+
+	lg := log.New(os.Stderr, log.FormatLogfmt, log.LevelInfo)
+
+	// The engine may be running, so only read.
+	conn, err := sqlite.OpenConn(*dbURI, sqlite.SQLITE_OPEN_READONLY|
+		sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX)
+	if err != nil {
+		lg.Error("failed to open database", "db", *dbURI, "err", err)
+		return 1
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	if *snapshot {
+		m, err := db.WriteSnapshot(conn, path)
+		if err != nil {
+			lg.Error("snapshot failed", "err", err)
+			return 1
+		}
+		lg.Info("snapshot written", "path", path,
+			"sync_height", m.SyncHeight, "tip_key_mr", m.TipKeyMR,
+			"duration", time.Since(start))
+		return 0
+	}
+	if err := db.Backup(conn, path); err != nil {
+		lg.Error("backup failed", "err", err)
+		return 1
+	}
+	lg.Info("backup written", "path", path, "duration", time.Since(start))
+	return 0
+}
+
+func dbCompress(args []string) int {
+	flags := flag.NewFlagSet("db compress", flag.ExitOnError)
+	dbURI := flags.String("db", defaultDBURI(), "SQLite Database URI")
+	decompress := flags.Bool("decompress", false, "Decompress all blocks instead")
+	noVacuum := flags.Bool("no-vacuum", false, "Do not VACUUM the database afterwards to shrink the file")
+	flags.Parse(args)
+
+	lg := log.New(os.Stderr, log.FormatLogfmt, log.LevelInfo)
+
+	conn, err := sqlite.OpenConn(*dbURI, sqlite.SQLITE_OPEN_READWRITE|
+		sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX)
+	if err != nil {
+		lg.Error("failed to open database", "db", *dbURI, "err", err)
+		return 1
+	}
+	defer conn.Close()
+
+	pending, err := db.PendingMigrations(conn)
+	if err != nil {
+		lg.Error("failed to plan migrations", "err", err)
+		return 1
+	}
+	if len(pending) > 0 {
+		lg.Error("database schema is out of date, " +
+			"run: fblock-scan db migrate")
+		return 1
+	}
+
+	compression := db.CompressionDeflate
+	if *decompress {
+		compression = db.CompressionNone
+	}
+	start := time.Now()
+	n, saved, err := db.CompressFBlocks(conn, compression, lg)
+	if err != nil {
+		lg.Error("compression failed", "err", err)
+		return 1
+	}
+	lg.Info("blocks rewritten", "compression", compression, "count", n,
+		"saved_bytes", saved, "duration", time.Since(start))
+
+	if *noVacuum || n == 0 {
+		return 0
+	}
+	if err := db.Vacuum(conn); err != nil {
+		lg.Error("vacuum failed", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -34,8 +34,13 @@ func AddressAdd(conn *sqlite.Conn, adr *factom.FAAddress, add int64) (int64, err
 	return SelectAddressID(conn, adr)
 }
 
+// InsertAddresses adds the inputs and outputs of tx to the balances of its
+// addresses and saves the net amount of each address under txID, flagged as a
+// reward if reward is true. Nothing is saved unless tx involves an address
+// in whitelist, or whitelist is nil.
 func InsertAddresses(conn *sqlite.Conn, tx factom.Transaction,
-	txID int64, whitelist map[factom.FAAddress]struct{}) (err error) {
+	txID int64, reward bool,
+	whitelist map[factom.FAAddress]struct{}) (err error) {
 
 	// If the tx does not contain an address in the whitelist, then we
 	// rollback all changes.
@@ -54,12 +59,13 @@ func InsertAddresses(conn *sqlite.Conn, tx factom.Transaction,
 		save = true
 	}
 	stmt := conn.Prep(`INSERT INTO "address_transaction"
-                ("tx_id", "adr_id", "amount") VALUES
-                (?, ?, ?)
+                ("tx_id", "reward", "adr_id", "amount") VALUES
+                (?, ?, ?, ?)
                 ON CONFLICT("tx_id", "adr_id") DO
                 UPDATE SET "amount" = "amount" + "excluded"."amount";`)
 	defer stmt.Reset()
 	stmt.BindInt64(sqlite.BindIndexStart, txID)
+	stmt.BindBool(sqlite.BindIndexStart+1, reward)
 
 	sign := int64(-1) // Subtract all inputs.
 	for _, adrs := range [][]factom.AddressAmount{tx.FCTInputs, tx.FCTOutputs} {
@@ -76,7 +82,7 @@ func InsertAddresses(conn *sqlite.Conn, tx factom.Transaction,
 				return err
 			}
 
-			i := sqlite.NewIncrementor(sqlite.BindIndexStart + 1)
+			i := sqlite.NewIncrementor(sqlite.BindIndexStart + 2)
 			stmt.BindInt64(i(), adrID)
 			stmt.BindInt64(i(), amount)
 			if _, err = stmt.Step(); err != nil {
@@ -96,7 +102,8 @@ func InsertAddresses(conn *sqlite.Conn, tx factom.Transaction,
 
 const sqlitexNoResultsErr = "sqlite: statement has no results"
 
-// SelectIDBalance returns the id and balance for the given adr.
+// SelectIDBalance returns the id and balance for the given adr. The balance
+// is incomplete if CheckBalancesScanned reports unscanned heights.
 func SelectAddressIDBalance(conn *sqlite.Conn,
 	adr *factom.FAAddress) (adrID int64, bal uint64, err error) {
 	adrID = -1
@@ -129,7 +136,8 @@ func SelectAddressID(conn *sqlite.Conn, adr *factom.FAAddress) (int64, error) {
 }
 
 // SelectAddressCount returns the number of rows in "address". If nonZeroOnly
-// is true, then only count the address with a non zero balance.
+// is true, then only count the address with a non zero balance, which is
+// incomplete if CheckBalancesScanned reports unscanned heights.
 func SelectAddressCount(conn *sqlite.Conn, nonZeroOnly bool) (int64, error) {
 	stmt := conn.Prep(`SELECT count(*) FROM "address" WHERE "id" != 1
                 AND (? OR "balance" > 0);`)
@@ -137,3 +145,25 @@ func SelectAddressCount(conn *sqlite.Conn, nonZeroOnly bool) (int64, error) {
 	stmt.BindBool(sqlite.BindIndexStart, !nonZeroOnly)
 	return sqlitex.ResultInt64(stmt)
 }
+
+// CheckBalancesScanned returns the ranges of heights below the latest scanned
+// height which have not been scanned, in which case address balances are
+// incomplete. The heights below the first scanned range are only included if
+// fromZero is true, since a whitelist database may intentionally start after
+// the first use of its addresses.
+func CheckBalancesScanned(conn *sqlite.Conn,
+	fromZero bool) (UnscannedError, error) {
+	ranges, err := SelectScannedRanges(conn)
+	if err != nil || len(ranges) == 0 {
+		return nil, err
+	}
+	from := ranges[0].Start
+	if fromZero {
+		from = 0
+	}
+	err = CheckScanned(conn, from, ranges[len(ranges)-1].End)
+	if unscanned, ok := err.(UnscannedError); ok {
+		return unscanned, nil
+	}
+	return nil, err
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"crawshaw.io/sqlite"
+)
+
+// Backup writes a consistent copy of the database of conn to path using the
+// SQLite online backup API. In WAL mode this does not block writers to the
+// database. The copy is written to a temporary file which then atomically
+// replaces any existing file at path.
+func Backup(conn *sqlite.Conn, path string) error {
+	tmp := path + ".tmp"
+	if err := removeDB(tmp); err != nil {
+		return err
+	}
+	dst, err := conn.BackupToDB("", tmp)
+	if err != nil {
+		removeDB(tmp)
+		return fmt.Errorf("sqlite.Conn.BackupToDB(): %w", err)
+	}
+	// Closing the last connection checkpoints and removes the WAL, so
+	// the copy is a single file.
+	if err := dst.Close(); err != nil {
+		removeDB(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeDB removes the database file at path, along with any WAL and shared
+// memory files.
+func removeDB(path string) error {
+	for _, path := range []string{path, path + "-wal", path + "-shm"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SnapshotFormat is the version of the snapshot format written by
+// WriteSnapshot.
+const SnapshotFormat = 1
+
+// Snapshot file names within the tar archive.
+const (
+	snapshotManifest = "manifest.json"
+	snapshotDB       = "fblock-scan.sqlite3"
+)
+
+// Manifest describes the database within a snapshot.
+type Manifest struct {
+	Format        int       `json:"format"`
+	SchemaVersion int64     `json:"schema_version"`
+	Created       time.Time `json:"created"`
+
+	// SyncHeight is the height of the latest FBlock, and TipKeyMR is its
+	// KeyMR, which the chain of saved FBlocks can be verified against.
+	SyncHeight uint32 `json:"sync_height"`
+	TipKeyMR   string `json:"tip_key_mr"`
+
+	// Size is the size in bytes, and SHA256 is the hex encoded hash, of
+	// the database file.
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// WriteSnapshot writes a snapshot of the database of conn to path, which
+// atomically replaces any existing file.
+//
+// A snapshot is a gzip compressed tar archive containing "manifest.json",
+// which is the JSON encoded Manifest, followed by "fblock-scan.sqlite3",
+// which is a copy of the database written with Backup.
+func WriteSnapshot(conn *sqlite.Conn, path string) (Manifest, error) {
+	var m Manifest
+	dbPath := path + ".sqlite3.tmp"
+	if err := Backup(conn, dbPath); err != nil {
+		return m, err
+	}
+	defer removeDB(dbPath)
+
+	m, err := newManifest(dbPath)
+	if err != nil {
+		return m, err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return m, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if err := writeSnapshot(f, m, dbPath); err != nil {
+		return m, err
+	}
+	if err := f.Sync(); err != nil {
+		return m, err
+	}
+	if err := f.Close(); err != nil {
+		return m, err
+	}
+	return m, os.Rename(tmp, path)
+}
+
+// newManifest returns the Manifest of the database file at dbPath.
+func newManifest(dbPath string) (Manifest, error) {
+	m := Manifest{Format: SnapshotFormat, Created: time.Now().UTC()}
+
+	conn, err := sqlite.OpenConn(dbPath, sqlite.SQLITE_OPEN_READONLY)
+	if err != nil {
+		return m, err
+	}
+	defer conn.Close()
+	if m.SchemaVersion, err = getDBVersion(conn); err != nil {
+		return m, err
+	}
+	if m.SyncHeight, err = SelectSyncHeight(conn); err != nil {
+		return m, err
+	}
+	keyMR, err := SelectFBlockKeyMR(conn, m.SyncHeight)
+	if err != nil {
+		if err == ErrNoFBlock {
+			return m, fmt.Errorf("database is empty")
+		}
+		return m, err
+	}
+	m.TipKeyMR = keyMR.String()
+
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if m.Size, err = io.Copy(hash, f); err != nil {
+		return m, err
+	}
+	m.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return m, nil
+}
+
+func writeSnapshot(w io.Writer, m Manifest, dbPath string) error {
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: snapshotManifest,
+		Mode: 0644, Size: int64(len(manifest)),
+		ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	db, err := os.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: snapshotDB,
+		Mode: 0644, Size: m.Size, ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, db); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
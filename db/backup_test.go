@@ -0,0 +1,83 @@
+package db
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackup(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	conn, err := sqlite.OpenConn(filepath.Join(dir, "test.sqlite3"), 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+
+	_, err = WriteSnapshot(conn, filepath.Join(dir, "empty.tar.gz"))
+	require.EqualError(err, "database is empty")
+
+	var fb factom.FBlock
+	require.NoError(fb.UnmarshalBinary(fblockData))
+	fb.PrevKeyMR = new(factom.Bytes32)
+	require.NoError(InsertFBlock(conn, fb, 0, CompressionNone, nil), "InsertFBlock()")
+
+	backup := filepath.Join(dir, "backup.sqlite3")
+	require.NoError(Backup(conn, backup), "Backup()")
+	require.NoError(Backup(conn, backup), "Backup(), replace")
+	_, err = os.Stat(backup + "-wal")
+	require.True(os.IsNotExist(err), "no WAL")
+	dup, err := sqlite.OpenConn(backup, sqlite.SQLITE_OPEN_READONLY)
+	require.NoError(err)
+	defer dup.Close()
+	keyMR, err := SelectFBlockKeyMR(dup, fb.Height)
+	require.NoError(err)
+	require.Equal(*fb.KeyMR, keyMR)
+
+	snapshot := filepath.Join(dir, "snapshot.tar.gz")
+	m, err := WriteSnapshot(conn, snapshot)
+	require.NoError(err, "WriteSnapshot()")
+	require.Equal(SnapshotFormat, m.Format)
+	require.Equal(currentDBVersion, m.SchemaVersion)
+	require.Equal(fb.Height, m.SyncHeight)
+	require.Equal(fb.KeyMR.String(), m.TipKeyMR)
+
+	f, err := os.Open(snapshot)
+	require.NoError(err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(err)
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	require.NoError(err)
+	require.Equal(snapshotManifest, hdr.Name, "manifest first")
+	var manifest Manifest
+	require.NoError(json.NewDecoder(tr).Decode(&manifest))
+	require.Equal(m.TipKeyMR, manifest.TipKeyMR)
+
+	hdr, err = tr.Next()
+	require.NoError(err)
+	require.Equal(snapshotDB, hdr.Name)
+	hash := sha256.New()
+	size, err := io.Copy(hash, tr)
+	require.NoError(err)
+	require.Equal(m.Size, size)
+	require.Equal(m.SHA256, hex.EncodeToString(hash.Sum(nil)))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*tmp*"))
+	require.NoError(err)
+	require.Empty(files, "temporary files removed")
+}
@@ -1,12 +1,18 @@
 package db
 
 import (
+	"bytes"
+	"compress/flate"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"time"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
 )
 
 const CreateTableFBlock = `CREATE TABLE "fblock"(
@@ -16,13 +22,98 @@ const CreateTableFBlock = `CREATE TABLE "fblock"(
         "ec_exchange_rate" INT NOT NULL,
         "price" REAL, -- Denoted in USD
         "key_mr" BLOB NOT NULL,
-        "data" BLOB NOT NULL
+        "data" BLOB NOT NULL, -- only the header, if pruned
+        "compression" INT NOT NULL DEFAULT 0, -- 0: none, 1: DEFLATE
+        "pruned" INT NOT NULL DEFAULT 0,      -- 1 if "data" was pruned
+
+        -- sums of "transaction"."fee" and "fee_ec"
+        "total_fee" INT NOT NULL DEFAULT 0,   -- denoted in factoshis
+        "total_fee_ec" INT NOT NULL DEFAULT 0 -- denoted in Entry Credits
 );
 `
 const CreateIndexFBlockKeyMR = `CREATE INDEX IF NOT EXISTS "idx_fblock_key_mr"
         ON "fblock"("key_mr");`
 
+// Compression is the algorithm used to compress "fblock"."data", which is
+// saved per FBlock in "fblock"."compression".
+type Compression int
+
+const (
+	// CompressionNone saves the marshaled FBlock as is.
+	CompressionNone Compression = iota
+
+	// CompressionDeflate saves the marshaled FBlock compressed with
+	// DEFLATE (RFC 1951).
+	CompressionDeflate
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionDeflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// compress returns data compressed with c, unless that is not smaller, in
+// which case data is returned with CompressionNone.
+func compress(data []byte, c Compression) ([]byte, Compression, error) {
+	if c == CompressionNone {
+		return data, c, nil
+	}
+	if c != CompressionDeflate {
+		return nil, c, fmt.Errorf("unknown compression: %v", c)
+	}
+	var buf bytes.Buffer
+	// FBlocks are written once but read many times, and decompression is
+	// no slower for the best compression level.
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, c, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, c, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, c, err
+	}
+	if buf.Len() >= len(data) {
+		return data, CompressionNone, nil
+	}
+	return buf.Bytes(), c, nil
+}
+
+// decompressReader returns a reader of the data read from r, which was
+// compressed with c.
+func decompressReader(r io.Reader, c Compression) (io.Reader, error) {
+	switch c {
+	case CompressionNone:
+		return r, nil
+	case CompressionDeflate:
+		return flate.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression: %v", c)
+}
+
+// decompress returns data, which was compressed with c, decompressed.
+func decompress(data []byte, c Compression) ([]byte, error) {
+	if c == CompressionNone {
+		return data, nil
+	}
+	r, err := decompressReader(bytes.NewReader(data), c)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// InsertFBlock saves fb, compressed with compression, along with its
+// Transactions, and updates the balances of any whitelisted addresses, or
+// all addresses if whitelist is nil.
 func InsertFBlock(conn *sqlite.Conn, fb factom.FBlock, price float64,
+	compression Compression,
 	whitelist map[factom.FAAddress]struct{}) (err error) {
 
 	if err = checkFBlockContinuity(conn, fb); err != nil {
@@ -33,6 +124,17 @@ func InsertFBlock(conn *sqlite.Conn, fb factom.FBlock, price float64,
 	if err != nil {
 		return fmt.Errorf("factom.FBlock.MarshalBinary(): %w", err)
 	}
+	data, compression, err = compress(data, compression)
+	if err != nil {
+		return err
+	}
+
+	var fee, feeEC uint64
+	for _, tx := range fb.Transactions {
+		txFee := Fee(tx)
+		fee += txFee
+		feeEC += FeeEC(txFee, fb.ECExchangeRate)
+	}
 
 	defer sqlitex.Save(conn)(&err)
 
@@ -43,8 +145,11 @@ func InsertFBlock(conn *sqlite.Conn, fb factom.FBlock, price float64,
                 "ec_exchange_rate",
                 "price",
                 "key_mr",
-                "data"
-        ) VALUES (?, ?, ?, ?, ?, ?, ?);`)
+                "data",
+                "compression",
+                "total_fee",
+                "total_fee_ec"
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
 	defer stmt.Reset()
 
 	i := sqlite.BindIncrementor()
@@ -59,27 +164,64 @@ func InsertFBlock(conn *sqlite.Conn, fb factom.FBlock, price float64,
 	}
 	stmt.BindBytes(i(), fb.KeyMR[:])
 	stmt.BindBytes(i(), data)
+	stmt.BindInt64(i(), int64(compression))
+	stmt.BindInt64(i(), int64(fee))
+	stmt.BindInt64(i(), int64(feeEC))
 
 	_, err = stmt.Step()
 	if err != nil {
 		return err
 	}
 
+	if err = insertScannedHeight(conn, fb.Height); err != nil {
+		return err
+	}
+
 	return InsertAllTransactions(conn, fb, whitelist)
 }
+
+// checkFBlockContinuity verifies that fb links to the previous and next
+// FBlocks, if they are saved.
+//
+// The previous FBlock may be missing if its height has not been scanned,
+// such as when starting a new database from a start height, or scanning a
+// range above or between existing ranges, which leaves a gap recorded in
+// "scanned_range". If the next FBlock is saved, then fb is filling a gap,
+// and the seam with the later range is verified.
 func checkFBlockContinuity(conn *sqlite.Conn, fb factom.FBlock) error {
-	if fb.PrevKeyMR.IsZero() {
-		// This is the first FBlock in the chain.
+	if !fb.PrevKeyMR.IsZero() { // Not the first FBlock in the chain.
+		prevKeyMR, err := SelectFBlockKeyMR(conn, fb.Height-1)
+		switch {
+		case errors.Is(err, ErrNoFBlock):
+			// Only a scanned height must have its FBlock.
+			err := CheckScanned(conn, fb.Height-1, fb.Height-1)
+			if err == nil {
+				return fmt.Errorf("missing FBlock %v", fb.Height-1)
+			}
+			if _, ok := err.(UnscannedError); !ok {
+				return err
+			}
+		case err != nil:
+			return fmt.Errorf("fblock.SelectFBlockKeyMR(height: %v): %w",
+				fb.Height-1, err)
+		case *fb.PrevKeyMR != prevKeyMR:
+			return fmt.Errorf("invalid FBlock.PrevKeyMR, expected:%v but got:%v",
+				prevKeyMR, fb.PrevKeyMR)
+		}
+	}
+
+	// The header, and so PrevKeyMR, of a pruned FBlock is saved.
+	next, err := SelectFBlockByHeight(conn, fb.Height+1)
+	if errors.Is(err, ErrNoFBlock) {
 		return nil
 	}
-	prevKeyMR, err := SelectFBlockKeyMR(conn, fb.Height-1)
-	if err != nil {
-		return fmt.Errorf("fblock.SelectFBlockKeyMR(height: %v): %w",
-			fb.Height-1, err)
+	if err != nil && !errors.Is(err, ErrPrunedFBlock) {
+		return fmt.Errorf("fblock.SelectFBlockByHeight(height: %v): %w",
+			fb.Height+1, err)
 	}
-	if *fb.PrevKeyMR != prevKeyMR {
-		return fmt.Errorf("invalid FBlock.PrevKeyMR, expected:%v but got:%v",
-			prevKeyMR, fb.PrevKeyMR)
+	if *next.PrevKeyMR != *fb.KeyMR {
+		return fmt.Errorf("invalid FBlock.KeyMR, next FBlock expected:%v but got:%v",
+			next.PrevKeyMR, fb.KeyMR)
 	}
 	return nil
 }
@@ -87,29 +229,50 @@ func checkFBlockContinuity(conn *sqlite.Conn, fb factom.FBlock) error {
 func InsertAllTransactions(conn *sqlite.Conn, fb factom.FBlock,
 	whitelist map[factom.FAAddress]struct{}) (err error) {
 	defer sqlitex.Save(conn)(&err)
-	offset := factom.FBlockHeaderMinSize + len(fb.Expansion)
-	lastTs := fb.Timestamp
-	for _, tx := range fb.Transactions {
-		// Advance the offset past any minute markers.
-		offset += int(tx.Timestamp.Sub(lastTs) / time.Minute)
-
-		txID, err := InsertTransaction(conn, tx, fb.Height, offset)
+	offsets := txOffsets(fb)
+	for i, tx := range fb.Transactions {
+		txType := transactionType(tx, i)
+		txID, err := InsertTransaction(conn, tx, fb.Height,
+			fb.ECExchangeRate, txType, offsets[i])
 		if err != nil {
 			return err
 		}
 
-		if err := InsertAddresses(conn, tx, txID, whitelist); err != nil {
+		if err := InsertTxIO(conn, tx, txID); err != nil {
 			return err
 		}
 
+		// All outputs of the coinbase Transaction are rewards.
+		if err := InsertAddresses(conn, tx, txID,
+			txType == TxTypeCoinbase, whitelist); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txOffsets returns the offset of each Transaction of fb within its data.
+func txOffsets(fb factom.FBlock) []int {
+	offsets := make([]int, len(fb.Transactions))
+	offset := factom.FBlockHeaderMinSize + len(fb.Expansion)
+	lastTs := fb.Timestamp
+	for i, tx := range fb.Transactions {
+		// Advance the offset past any minute markers.
+		offset += int(tx.Timestamp.Sub(lastTs) / time.Minute)
+		offsets[i] = offset
+
 		// Advance the offset to the next tx.
 		offset += tx.MarshalBinaryLen()
 		lastTs = tx.Timestamp
 	}
-	return nil
+	return offsets
 }
 
-var selectFBlockWhere = `SELECT "data" FROM "fblock" WHERE `
+// ErrNoFBlock is returned when a requested FBlock has not been saved.
+var ErrNoFBlock = fmt.Errorf("no FBlock found")
+
+var selectFBlockWhere = `SELECT "data", "timestamp", "compression", "pruned"
+        FROM "fblock" WHERE `
 
 func SelectFBlockByKeyMR(conn *sqlite.Conn, keyMR *factom.Bytes32) (factom.FBlock, error) {
 	stmt := conn.Prep(selectFBlockWhere + `"key_mr" = ?;`)
@@ -131,12 +294,32 @@ func selectFBlock(stmt *sqlite.Stmt) (factom.FBlock, error) {
 		return fb, err
 	}
 	if !hasRow {
-		return fb, fmt.Errorf("no FBlock found")
+		return fb, ErrNoFBlock
 	}
 
-	i := sqlite.ColumnIndexStart
-	data := make([]byte, stmt.ColumnLen(i))
-	stmt.ColumnBytes(i, data)
+	i := sqlite.ColumnIncrementor()
+	data := make([]byte, stmt.ColumnLen(i()))
+	stmt.ColumnBytes(sqlite.ColumnIndexStart, data)
+
+	// The Timestamp must be set prior to unmarshaling so that the
+	// Transaction Timestamps are populated.
+	fb.Timestamp = time.Unix(stmt.ColumnInt64(i()), 0)
+
+	data, err = decompress(data, Compression(stmt.ColumnInt64(i())))
+	if err != nil {
+		return fb, fmt.Errorf("decompress: %w", err)
+	}
+
+	if stmt.ColumnInt(i()) != 0 {
+		// Only the header is saved.
+		timestamp := fb.Timestamp
+		fb, _, err := unmarshalFBlockHeader(data)
+		if err != nil {
+			return fb, err
+		}
+		fb.Timestamp = timestamp
+		return fb, ErrPrunedFBlock
+	}
 
 	if err := fb.UnmarshalBinary(data); err != nil {
 		return fb, fmt.Errorf("factom.FBlock.UnmarshalBinary(): %w", err)
@@ -145,6 +328,16 @@ func selectFBlock(stmt *sqlite.Stmt) (factom.FBlock, error) {
 	return fb, nil
 }
 
+// SelectFBlockPrice returns the price of FCT in USD at the time of the FBlock
+// with the given height, or 0 if the price is unknown.
+func SelectFBlockPrice(conn *sqlite.Conn, height uint32) (float64, error) {
+	stmt := conn.Prep(`SELECT ifnull("price", 0) FROM "fblock"
+                WHERE "height" = ?;`)
+	defer stmt.Reset()
+	stmt.BindInt64(sqlite.BindIndexStart, int64(height))
+	return sqlitex.ResultFloat(stmt)
+}
+
 func SelectSyncHeight(conn *sqlite.Conn) (uint32, error) {
 	stmt := conn.Prep(`SELECT "height" FROM "fblock" ORDER BY "height" DESC LIMIT 1;`)
 	defer stmt.Reset()
@@ -168,7 +361,7 @@ func SelectFBlockKeyMR(conn *sqlite.Conn, height uint32) (factom.Bytes32, error)
 		return keyMR, err
 	}
 	if !hasRow {
-		return keyMR, fmt.Errorf("no FBlock found")
+		return keyMR, ErrNoFBlock
 	}
 
 	if stmt.ColumnBytes(sqlite.ColumnIndexStart, keyMR[:]) != len(keyMR) {
@@ -177,3 +370,96 @@ func SelectFBlockKeyMR(conn *sqlite.Conn, height uint32) (factom.Bytes32, error)
 
 	return keyMR, err
 }
+
+// compressBatchSize is the number of FBlocks rewritten in each transaction by
+// CompressFBlocks.
+const compressBatchSize = 1000
+
+// CompressFBlocks rewrites the data of every saved FBlock, which is not
+// compressed with c or pruned, and returns the number of FBlocks rewritten and the
+// number of bytes saved, which is negative if the data grew. FBlocks are
+// rewritten in transactions of compressBatchSize so that the scanner is not
+// blocked for long, and progress is written to log.
+//
+// The file does not shrink until the database is VACUUMed.
+func CompressFBlocks(conn *sqlite.Conn, c Compression,
+	log log.Logger) (n int, saved int64, err error) {
+	after := int64(-1)
+	for {
+		var batch int
+		var batchSaved int64
+		after, batch, batchSaved, err = compressFBlocks(conn, c, after)
+		n += batch
+		saved += batchSaved
+		if err != nil || batch == 0 {
+			return
+		}
+		log.Info("compressing FBlocks", "height", after,
+			"count", n, "saved_bytes", saved)
+	}
+}
+
+// compressFBlocks rewrites up to compressBatchSize FBlocks above height after
+// which are not compressed with c, and returns the last height checked.
+func compressFBlocks(conn *sqlite.Conn, c Compression, after int64) (
+	last int64, n int, saved int64, err error) {
+	defer sqlitex.Save(conn)(&err)
+	last = after
+
+	type rewrite struct {
+		height int64
+		data   []byte
+	}
+	var fbs []rewrite
+	sel := conn.Prep(`SELECT "height", "data", "compression" FROM "fblock"
+                WHERE "height" > ? AND "compression" != ? AND NOT "pruned"
+                ORDER BY "height" LIMIT ?;`)
+	defer sel.Reset()
+	i := sqlite.BindIncrementor()
+	sel.BindInt64(i(), after)
+	sel.BindInt64(i(), int64(c))
+	sel.BindInt64(i(), compressBatchSize)
+	for {
+		hasRow, err := sel.Step()
+		if err != nil {
+			return last, 0, 0, err
+		}
+		if !hasRow {
+			break
+		}
+		i := sqlite.ColumnIncrementor()
+		height := sel.ColumnInt64(i())
+		col := i()
+		data := make([]byte, sel.ColumnLen(col))
+		sel.ColumnBytes(col, data)
+		saved += int64(len(data))
+		data, err = decompress(data, Compression(sel.ColumnInt64(i())))
+		if err != nil {
+			return last, 0, 0, fmt.Errorf("FBlock %v: %w", height, err)
+		}
+		fbs = append(fbs, rewrite{height, data})
+	}
+
+	update := conn.Prep(`UPDATE "fblock" SET "data" = ?, "compression" = ?
+                WHERE "height" = ?;`)
+	defer update.Reset()
+	for _, fb := range fbs {
+		data, compression, err := compress(fb.data, c)
+		if err != nil {
+			return last, 0, 0, err
+		}
+		i := sqlite.BindIncrementor()
+		update.BindBytes(i(), data)
+		update.BindInt64(i(), int64(compression))
+		update.BindInt64(i(), fb.height)
+		if _, err := update.Step(); err != nil {
+			return last, 0, 0, err
+		}
+		if err := update.Reset(); err != nil {
+			return last, 0, 0, err
+		}
+		saved -= int64(len(data))
+		last = fb.height
+	}
+	return last, len(fbs), saved, nil
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	require := require.New(t)
+	conn := openMemory(t)
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+
+	fbs := fblockChain(t, 3)
+	for i, fb := range fbs {
+		c := CompressionDeflate
+		if i == 0 {
+			c = CompressionNone
+		}
+		require.NoError(InsertFBlock(conn, fb, 0, c, nil), "InsertFBlock()")
+	}
+	requireFBlocks := func(c Compression) {
+		for _, fb := range fbs {
+			size, compression := selectDataSize(t, conn, fb.Height)
+			require.Equal(c, compression, "height %v", fb.Height)
+			if c == CompressionDeflate {
+				require.Less(size, len(fblockData))
+			}
+
+			saved, err := SelectFBlockByHeight(conn, fb.Height)
+			require.NoError(err, "SelectFBlockByHeight()")
+			require.Equal(*fb.KeyMR, *saved.KeyMR)
+			for _, tx := range fb.Transactions {
+				saved, err := SelectTransactionByHash(conn, tx.ID)
+				require.NoError(err, "SelectTransactionByHash()")
+				require.Equal(tx.ID, saved.ID)
+			}
+		}
+	}
+
+	n, saved, err := CompressFBlocks(conn, CompressionDeflate, log.Logger{})
+	require.NoError(err, "CompressFBlocks()")
+	require.Equal(1, n)
+	require.Greater(saved, int64(0))
+	requireFBlocks(CompressionDeflate)
+
+	n, _, err = CompressFBlocks(conn, CompressionDeflate, log.Logger{})
+	require.NoError(err, "CompressFBlocks(), again")
+	require.Zero(n)
+
+	n, saved, err = CompressFBlocks(conn, CompressionNone, log.Logger{})
+	require.NoError(err, "CompressFBlocks(), none")
+	require.Equal(len(fbs), n)
+	require.Less(saved, int64(0))
+	requireFBlocks(CompressionNone)
+}
+
+// selectDataSize returns the saved size and Compression of the data of the
+// FBlock at height.
+func selectDataSize(t testing.TB, conn *sqlite.Conn,
+	height uint32) (int, Compression) {
+	var size int
+	var c Compression
+	require.NoError(t, sqlitex.Exec(conn, `SELECT length("data"), "compression"
+                FROM "fblock" WHERE "height" = ?;`,
+		func(stmt *sqlite.Stmt) error {
+			size = stmt.ColumnInt(0)
+			c = Compression(stmt.ColumnInt(1))
+			return nil
+		}, int64(height)))
+	return size, c
+}
+
+// benchmarkCompressions runs bench against a database of one FBlock saved
+// with each Compression, and reports the size of its data.
+func benchmarkCompressions(b *testing.B,
+	bench func(b *testing.B, conn *sqlite.Conn, fb factom.FBlock)) {
+	for _, c := range []Compression{CompressionNone, CompressionDeflate} {
+		b.Run(c.String(), func(b *testing.B) {
+			conn, err := sqlite.OpenConn(":memory:", 0)
+			require.NoError(b, err, "sqlite.OpenConn()")
+			defer conn.Close()
+			require.NoError(b, Setup(conn, false, log.Logger{}))
+			fb := fblockChain(b, 1)[0]
+			require.NoError(b, InsertFBlock(conn, fb, 0, c, nil))
+
+			size, _ := selectDataSize(b, conn, fb.Height)
+			b.ResetTimer()
+			bench(b, conn, fb)
+			b.ReportMetric(float64(size), "bytes/fblock")
+		})
+	}
+}
+
+func BenchmarkSelectFBlock(b *testing.B) {
+	benchmarkCompressions(b,
+		func(b *testing.B, conn *sqlite.Conn, fb factom.FBlock) {
+			for i := 0; i < b.N; i++ {
+				if _, err := SelectFBlockByHeight(conn,
+					fb.Height); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+}
+
+func BenchmarkSelectTransaction(b *testing.B) {
+	benchmarkCompressions(b,
+		func(b *testing.B, conn *sqlite.Conn, fb factom.FBlock) {
+			// The last Transaction must decompress the most data.
+			txID := fb.Transactions[len(fb.Transactions)-1].ID
+			for i := 0; i < b.N; i++ {
+				if _, err := SelectTransactionByHash(conn,
+					txID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// populateFees is the SQL that computes "transaction"."fee" and "fee_ec",
+// and their totals per FBlock, for all saved Transactions.
+const populateFees = `UPDATE "transaction" SET
+        "fee" = max("total_fct_in" - "total_fct_out" - "total_ec_out", 0);
+UPDATE "transaction" SET "fee_ec" = ifnull("fee" / (
+        SELECT nullif("ec_exchange_rate", 0) FROM "fblock"
+                WHERE "fblock"."height" = "transaction"."height"), 0);
+UPDATE "fblock" SET ("total_fee", "total_fee_ec") = (
+        SELECT ifnull(sum("fee"), 0), ifnull(sum("fee_ec"), 0)
+                FROM "transaction"
+                WHERE "transaction"."height" = "fblock"."height");
+`
+
+// Fee returns the fee paid by tx, denoted in factoshis, which is the amount
+// by which its inputs exceed its FCT and EC outputs. A coinbase Transaction,
+// which has no inputs, pays no fee.
+func Fee(tx factom.Transaction) uint64 {
+	if tx.TotalIn < tx.TotalFCTOut+tx.TotalECOut {
+		return 0
+	}
+	return tx.TotalIn - tx.TotalFCTOut - tx.TotalECOut
+}
+
+// FeeEC converts fee from factoshis to Entry Credits at ecRate, the
+// "fblock"."ec_exchange_rate", rounding down.
+func FeeEC(fee, ecRate uint64) uint64 {
+	if ecRate == 0 {
+		return 0
+	}
+	return fee / ecRate
+}
+
+// SelectFBlockFees returns the total fees paid by the Transactions of the
+// FBlock at height, denoted in factoshis and in Entry Credits.
+func SelectFBlockFees(conn *sqlite.Conn, height uint32) (fee, feeEC uint64,
+	err error) {
+	stmt := conn.Prep(`SELECT "total_fee", "total_fee_ec" FROM "fblock"
+                WHERE "height" = ?;`)
+	defer stmt.Reset()
+	stmt.BindInt64(sqlite.BindIndexStart, int64(height))
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return 0, 0, err
+	}
+	if !hasRow {
+		return 0, 0, ErrNoFBlock
+	}
+	return uint64(stmt.ColumnInt64(0)), uint64(stmt.ColumnInt64(1)), nil
+}
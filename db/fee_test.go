@@ -0,0 +1,57 @@
+package db
+
+import (
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFees(t *testing.T) {
+	require := require.New(t)
+
+	conn := openMemory(t)
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+	_, _, err := SelectFBlockFees(conn, 0)
+	require.Equal(ErrNoFBlock, err)
+
+	// A coinbase Transaction has no inputs.
+	coinbase := fblockChain(t, 1)[0].Transactions[0]
+	require.Empty(coinbase.FCTInputs)
+	require.Zero(Fee(coinbase))
+}
+
+// checkFees checks the fees of every Transaction in fbs, and their totals.
+func checkFees(require *require.Assertions, conn *sqlite.Conn,
+	fbs []factom.FBlock, msg string) {
+	for _, fb := range fbs {
+		var fees, feesEC []uint64
+		require.NoError(sqlitex.Exec(conn, `SELECT "fee", "fee_ec"
+                        FROM "transaction" WHERE "height" = ?
+                        ORDER BY "id";`,
+			func(stmt *sqlite.Stmt) error {
+				fees = append(fees, uint64(stmt.ColumnInt64(0)))
+				feesEC = append(feesEC, uint64(stmt.ColumnInt64(1)))
+				return nil
+			}, fb.Height))
+		require.Len(fees, len(fb.Transactions))
+
+		var total, totalEC uint64
+		for i, tx := range fb.Transactions {
+			fee := Fee(tx)
+			require.Equal(fee, fees[i], msg)
+			require.Equal(fee/fb.ECExchangeRate, feesEC[i], msg)
+			total += fee
+			totalEC += feesEC[i]
+		}
+		require.NotZero(total, "no fees in test data")
+
+		fee, feeEC, err := SelectFBlockFees(conn, fb.Height)
+		require.NoError(err, "SelectFBlockFees()")
+		require.Equal(total, fee, msg)
+		require.Equal(totalEC, feeEC, msg)
+	}
+}
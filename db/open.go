@@ -2,12 +2,23 @@ package db
 
 import (
 	"fmt"
+	"strings"
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"github.com/canonical-ledgers/fblock-scan/log"
 )
 
-func Setup(conn *sqlite.Conn, speed bool) error {
+// Setup validates the application_id, enables WAL journal mode, applies any
+// pending migrations, after backing up the database, and configures conn.
+// Migration progress is written to log.
+//
+// If speed is true, conn is configured for bulk loading until EndSpeed is
+// called. See optimizeSpeed. A bulk load is recorded in the database until
+// EndSpeed succeeds, and while it is, Setup checks the database for
+// corruption and foreign key violations, regardless of speed, and the check
+// clears the record if speed is false.
+func Setup(conn *sqlite.Conn, speed bool, log log.Logger) error {
 	if err := checkOrSetApplicationID(conn); err != nil {
 		return err
 	}
@@ -16,25 +27,67 @@ func Setup(conn *sqlite.Conn, speed bool) error {
 		return err
 	}
 
-	if err := applyMigrations(conn); err != nil {
+	if err := enableWAL(conn); err != nil {
 		return err
 	}
 
+	if err := Migrate(conn, log, true); err != nil {
+		return err
+	}
+
+	// A previous bulk load may have been interrupted by a crash, or by
+	// a foreign key violation.
+	bulk, err := bulkLoadInProgress(conn)
+	if err != nil {
+		return err
+	}
+	if bulk || speed {
+		if err := quickCheck(conn); err != nil {
+			return err
+		}
+	}
+	if bulk {
+		if err := foreignKeyCheck(conn); err != nil {
+			return fmt.Errorf("interrupted bulk load: %w", err)
+		}
+	}
+	if speed != bulk {
+		if err := setBulkLoad(conn, speed); err != nil {
+			return err
+		}
+	}
 	if !speed {
 		return nil
 	}
 	return optimizeSpeed(conn)
 }
 
+// bulkLoadInProgress returns whether the bulkLoadFlag is set, because
+// EndSpeed has not succeeded since Setup was last called with speed.
+func bulkLoadInProgress(conn *sqlite.Conn) (bool, error) {
+	version, err := selectUserVersion(conn)
+	return version&bulkLoadFlag != 0, err
+}
+
+// setBulkLoad sets or clears the bulkLoadFlag.
+func setBulkLoad(conn *sqlite.Conn, bulk bool) error {
+	version, err := selectUserVersion(conn)
+	if err != nil {
+		return err
+	}
+	if bulk {
+		version |= bulkLoadFlag
+	} else {
+		version &^= bulkLoadFlag
+	}
+	return setUserVersion(conn, version)
+}
+
 const ApplicationID int32 = 0x0FAC701D
 
 func checkOrSetApplicationID(conn *sqlite.Conn) error {
-	var appID int32
-	if err := sqlitex.ExecTransient(conn, `PRAGMA "application_id";`,
-		func(stmt *sqlite.Stmt) error {
-			appID = stmt.ColumnInt32(0)
-			return nil
-		}); err != nil {
+	appID, err := selectApplicationID(conn)
+	if err != nil {
 		return err
 	}
 	switch appID {
@@ -49,6 +102,29 @@ func checkOrSetApplicationID(conn *sqlite.Conn) error {
 	return fmt.Errorf("invalid database: application_id")
 }
 
+// checkApplicationID returns an error if the application_id is set, but not
+// to ApplicationID.
+func checkApplicationID(conn *sqlite.Conn) error {
+	appID, err := selectApplicationID(conn)
+	if err != nil {
+		return err
+	}
+	if appID != 0 && appID != ApplicationID {
+		return fmt.Errorf("invalid database: application_id")
+	}
+	return nil
+}
+
+func selectApplicationID(conn *sqlite.Conn) (int32, error) {
+	var appID int32
+	err := sqlitex.ExecTransient(conn, `PRAGMA "application_id";`,
+		func(stmt *sqlite.Stmt) error {
+			appID = stmt.ColumnInt32(0)
+			return nil
+		})
+	return appID, err
+}
+
 func enableForeignKeyChecks(conn *sqlite.Conn) error {
 	stmt, _, err := conn.PrepareTransient(`PRAGMA foreign_keys = ON;`)
 	if err != nil {
@@ -59,20 +135,95 @@ func enableForeignKeyChecks(conn *sqlite.Conn) error {
 	return err
 }
 
+// optimizeSpeed disables syncing to disk and foreign key checks on conn.
+//
+// This is only crash safe if the WAL is never checkpointed except by
+// DurableCheckpoint, so that the database file itself is always consistent
+// as of the latest DurableCheckpoint. Any later commits that were not
+// fully written to the WAL before a crash are discarded by SQLite on
+// recovery, and are scanned again.
 func optimizeSpeed(conn *sqlite.Conn) error {
+	// These cannot be set within a transaction, so ExecScript, which
+	// uses a savepoint, cannot be used.
 	for _, sql := range []string{
 		`PRAGMA synchronous = OFF;`,
-		`PRAGMA journal_mode = MEMORY;`,
 		`PRAGMA foreign_keys = OFF;`,
 	} {
-		stmt, _, err := conn.PrepareTransient(sql)
-		if err != nil {
-			return err
-		}
-		defer stmt.Finalize()
-		if _, err := stmt.Step(); err != nil {
+		if err := sqlitex.ExecTransient(conn, sql, nil); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// EndSpeed restores the safe configuration of conn after a bulk load,
+// verifies that all foreign keys are satisfied, and durably checkpoints the
+// WAL. It must not be called within a transaction.
+func EndSpeed(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecTransient(conn,
+		`PRAGMA synchronous = NORMAL;`, nil); err != nil {
+		return err
+	}
+	if err := enableForeignKeyChecks(conn); err != nil {
+		return err
+	}
+	if err := foreignKeyCheck(conn); err != nil {
+		return err
+	}
+	if err := setBulkLoad(conn, false); err != nil {
+		return err
+	}
+	_, err := DurableCheckpoint(conn)
+	return err
+}
+
+// foreignKeyCheck returns an error if any foreign key constraints are
+// violated.
+func foreignKeyCheck(conn *sqlite.Conn) error {
+	var violations int
+	var first string
+	err := sqlitex.ExecTransient(conn, `PRAGMA foreign_key_check;`,
+		func(stmt *sqlite.Stmt) error {
+			if violations == 0 {
+				first = fmt.Sprintf("%q rowid %v references %q",
+					stmt.ColumnText(0), stmt.ColumnInt64(1),
+					stmt.ColumnText(2))
+			}
+			violations++
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if violations > 0 {
+		return fmt.Errorf("%v foreign key violations, first: %v",
+			violations, first)
+	}
+	return nil
+}
+
+// quickCheck returns an error if the database is corrupt.
+func quickCheck(conn *sqlite.Conn) error {
+	var result []string
+	err := sqlitex.ExecTransient(conn, `PRAGMA quick_check;`,
+		func(stmt *sqlite.Stmt) error {
+			result = append(result, stmt.ColumnText(0))
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if len(result) != 1 || result[0] != "ok" {
+		return fmt.Errorf("database is corrupt: %v",
+			strings.Join(result, "; "))
+	}
+	return nil
+}
+
+// SelectDBSize returns the size of the database in bytes.
+func SelectDBSize(conn *sqlite.Conn) (int64, error) {
+	stmt := conn.Prep(`SELECT "page_count" * "page_size"
+                FROM pragma_page_count(), pragma_page_size();`)
+	defer stmt.Reset()
+	return sqlitex.ResultInt64(stmt)
+}
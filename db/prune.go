@@ -0,0 +1,273 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/Factom-Asset-Tokens/factom/varintf"
+	"github.com/canonical-ledgers/fblock-scan/log"
+)
+
+// CreateIndexTransactionHeight is the SQL that creates the index of
+// Transactions by FBlock height, which is used to prune FBlocks.
+const CreateIndexTransactionHeight = `CREATE INDEX "idx_transaction_height"
+        ON "transaction"("height");
+`
+
+// ErrPrunedFBlock is returned, along with the FBlock header, when the
+// requested FBlock has been pruned. The full FBlock may be fetched from
+// factomd by its KeyMR, as done by engine.Engine.FBlockByHeight.
+var ErrPrunedFBlock = fmt.Errorf("FBlock has been pruned")
+
+// pruneBatchSize is the number of FBlocks pruned in each transaction by
+// PruneFBlocks.
+const pruneBatchSize = 1000
+
+// PruneFBlocks prunes every saved FBlock from height from up to, but not
+// including, height to, and returns the number of FBlocks pruned. Progress is
+// written to log.
+//
+// The data of a pruned FBlock is replaced by its header, which is enough to
+// verify its KeyMR and PrevKeyMR, and the ledger data of each of its
+// Transactions is saved in "transaction"."ledger". A pruned FBlock is
+// returned by SelectFBlockByHeight with only its header and ErrPrunedFBlock,
+// and its Transactions are returned by SelectTransactionByHash without
+// their RCDs and signatures.
+//
+// FBlocks are pruned in transactions of pruneBatchSize. The file does not
+// shrink until the database is VACUUMed.
+func PruneFBlocks(conn *sqlite.Conn, from, to uint32,
+	log log.Logger) (n int, err error) {
+	for from < to {
+		var batch int
+		var last uint32
+		last, batch, err = pruneFBlocks(conn, from, to)
+		n += batch
+		if err != nil || batch < pruneBatchSize {
+			return
+		}
+		log.Info("pruning FBlocks", "height", last, "count", n)
+		from = last + 1
+	}
+	return
+}
+
+// pruneFBlocks prunes up to pruneBatchSize FBlocks from height from up to
+// height to, and returns the last height pruned.
+func pruneFBlocks(conn *sqlite.Conn, from, to uint32) (
+	last uint32, n int, err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	type pending struct {
+		height uint32
+		data   []byte
+	}
+	var fbs []pending
+	sel := conn.Prep(`SELECT "height", "data", "compression" FROM "fblock"
+                WHERE "height" >= ? AND "height" < ? AND NOT "pruned"
+                ORDER BY "height" LIMIT ?;`)
+	defer sel.Reset()
+	i := sqlite.BindIncrementor()
+	sel.BindInt64(i(), int64(from))
+	sel.BindInt64(i(), int64(to))
+	sel.BindInt64(i(), pruneBatchSize)
+	for {
+		hasRow, err := sel.Step()
+		if err != nil {
+			return last, 0, err
+		}
+		if !hasRow {
+			break
+		}
+		i := sqlite.ColumnIncrementor()
+		height := uint32(sel.ColumnInt64(i()))
+		col := i()
+		data := make([]byte, sel.ColumnLen(col))
+		sel.ColumnBytes(col, data)
+		data, err = decompress(data, Compression(sel.ColumnInt64(i())))
+		if err != nil {
+			return last, 0, fmt.Errorf("FBlock %v: %w", height, err)
+		}
+		fbs = append(fbs, pending{height, data})
+	}
+
+	for _, fb := range fbs {
+		if err := pruneFBlock(conn, fb.height, fb.data); err != nil {
+			return last, 0, fmt.Errorf("FBlock %v: %w", fb.height, err)
+		}
+		last = fb.height
+	}
+	return last, len(fbs), nil
+}
+
+// pruneFBlock saves the ledger data of each Transaction of the FBlock at
+// height from its data, and then replaces its data with its header.
+func pruneFBlock(conn *sqlite.Conn, height uint32, data []byte) error {
+	_, headerLen, err := unmarshalFBlockHeader(data)
+	if err != nil {
+		return err
+	}
+
+	type ledger struct {
+		id   int64
+		data []byte
+	}
+	var ledgers []ledger
+	sel := conn.Prep(`SELECT "id", "fb_offset", "size" FROM "transaction"
+                WHERE "height" = ?;`)
+	defer sel.Reset()
+	sel.BindInt64(sqlite.BindIndexStart, int64(height))
+	for {
+		hasRow, err := sel.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			break
+		}
+		i := sqlite.ColumnIncrementor()
+		id := sel.ColumnInt64(i())
+		offset, size := sel.ColumnInt64(i()), sel.ColumnInt64(i())
+		if offset+size > int64(len(data)) {
+			return fmt.Errorf("unexpected end of Transaction data")
+		}
+		txData := data[offset : offset+size]
+		_, n, err := unmarshalLedger(txData)
+		if err != nil {
+			return err
+		}
+		ledgers = append(ledgers, ledger{id, txData[:n]})
+	}
+
+	update := conn.Prep(`UPDATE "transaction" SET "ledger" = ?
+                WHERE "id" = ?;`)
+	defer update.Reset()
+	for _, l := range ledgers {
+		i := sqlite.BindIncrementor()
+		update.BindBytes(i(), l.data)
+		update.BindInt64(i(), l.id)
+		if _, err := update.Step(); err != nil {
+			return err
+		}
+		if err := update.Reset(); err != nil {
+			return err
+		}
+	}
+
+	prune := conn.Prep(`UPDATE "fblock"
+                SET "data" = ?, "compression" = ?, "pruned" = 1
+                WHERE "height" = ?;`)
+	defer prune.Reset()
+	i := sqlite.BindIncrementor()
+	prune.BindBytes(i(), data[:headerLen])
+	prune.BindInt64(i(), int64(CompressionNone))
+	prune.BindInt64(i(), int64(height))
+	_, err = prune.Step()
+	return err
+}
+
+// unmarshalFBlockHeader unmarshals the header of the FBlock from data,
+// computes its KeyMR, and returns the length of the header. The Transactions
+// are not populated.
+func unmarshalFBlockHeader(data []byte) (factom.FBlock, int, error) {
+	var fb factom.FBlock
+	// The fixed size fields preceding the Header Expansion size.
+	const fixedLen = 32*4 + 8 + 4
+	if len(data) < factom.FBlockHeaderMinSize {
+		return fb, 0, fmt.Errorf("insufficient FBlock header length")
+	}
+	if chainID := factom.FBlockChainID(); !bytes.Equal(data[:32],
+		chainID[:]) {
+		return fb, 0, fmt.Errorf("invalid factoid chainid")
+	}
+	fb.BodyMR = new(factom.Bytes32)
+	copy(fb.BodyMR[:], data[32:64])
+	fb.PrevKeyMR = new(factom.Bytes32)
+	copy(fb.PrevKeyMR[:], data[64:96])
+	fb.PrevLedgerKeyMR = new(factom.Bytes32)
+	copy(fb.PrevLedgerKeyMR[:], data[96:128])
+	fb.ECExchangeRate = binary.BigEndian.Uint64(data[128:136])
+	fb.Height = binary.BigEndian.Uint32(data[136:fixedLen])
+
+	expansionSize, read := varintf.Decode(data[fixedLen:])
+	if read <= 0 {
+		return fb, 0, fmt.Errorf("invalid FBlock header expansion size")
+	}
+	i := fixedLen + read
+	if expansionSize > uint64(len(data[i:])-8) {
+		return fb, 0, fmt.Errorf("insufficient FBlock header length")
+	}
+	fb.Expansion = data[i : i+int(expansionSize)]
+	i += int(expansionSize) + 8 // Transaction Count and Body Size
+
+	headerHash := sha256.Sum256(data[:i])
+	keyMR, err := factom.ComputeFBlockKeyMR(
+		[][]byte{headerHash[:], fb.BodyMR[:]})
+	if err != nil {
+		return fb, 0, err
+	}
+	fb.KeyMR = &keyMR
+	return fb, i, nil
+}
+
+// unmarshalLedger unmarshals a Transaction from the start of data, which may
+// be either the full Transaction data or just its ledger data, and returns
+// the length of the ledger data. The Signatures are not populated, but the ID
+// is computed.
+func unmarshalLedger(data []byte) (factom.Transaction, int, error) {
+	var tx factom.Transaction
+	if len(data) < factom.TransactionHeaderSize {
+		return tx, 0, fmt.Errorf("insufficient Transaction length")
+	}
+	if data[0] != factom.TransactionVersion {
+		return tx, 0, fmt.Errorf("invalid Transaction version")
+	}
+
+	var salt [8]byte
+	copy(salt[2:], data[1:7])
+	ms := int64(binary.BigEndian.Uint64(salt[:]))
+	tx.TimestampSalt = time.Unix(0, ms*1e6)
+
+	inputs, outputs, ecOutputs := int(data[7]), int(data[8]), int(data[9])
+	i := 10
+
+	adrs := make([]factom.AddressAmount, inputs+outputs+ecOutputs)
+	for j := range adrs {
+		amount, size := varintf.Decode(data[i:])
+		if size <= 0 {
+			return tx, 0, fmt.Errorf("invalid Transaction amount")
+		}
+		i += size
+		if len(data[i:]) < 32 {
+			return tx, 0, fmt.Errorf("insufficient Transaction length")
+		}
+		adrs[j] = factom.AddressAmount{Address: data[i : i+32],
+			Amount: amount}
+		i += 32
+
+		switch {
+		case j < inputs:
+			tx.TotalIn += amount
+		case j < inputs+outputs:
+			tx.TotalFCTOut += amount
+		default:
+			tx.TotalECOut += amount
+		}
+	}
+	if tx.TotalIn >= tx.TotalFCTOut+tx.TotalECOut {
+		tx.TotalBurn = tx.TotalIn - tx.TotalFCTOut - tx.TotalECOut
+	}
+	tx.FCTInputs = adrs[:inputs]
+	tx.FCTOutputs = adrs[inputs : inputs+outputs]
+	tx.ECOutputs = adrs[inputs+outputs:]
+
+	id := factom.Bytes32(sha256.Sum256(data[:i]))
+	tx.ID = &id
+	return tx, i, nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrune(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	conn, err := sqlite.OpenConn(filepath.Join(dir, "test.sqlite3"), 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+
+	// The first FBlock is inserted after the rest are pruned.
+	fbs := fblockChain(t, 4)
+	for i, fb := range fbs[1:] {
+		c := CompressionNone
+		if i == 0 {
+			c = CompressionDeflate
+		}
+		require.NoError(InsertFBlock(conn, fb, 0, c, nil), "InsertFBlock()")
+	}
+
+	tip := fbs[len(fbs)-1]
+	n, err := PruneFBlocks(conn, 0, tip.Height, log.Logger{})
+	require.NoError(err, "PruneFBlocks()")
+	require.Equal(2, n)
+	n, err = PruneFBlocks(conn, 0, tip.Height, log.Logger{})
+	require.NoError(err, "PruneFBlocks(), again")
+	require.Zero(n)
+	require.NoError(InsertFBlock(conn, fbs[0], 0, CompressionNone, nil),
+		"InsertFBlock(), before a pruned FBlock")
+	n, err = PruneFBlocks(conn, fbs[0].Height, fbs[0].Height+1, log.Logger{})
+	require.NoError(err, "PruneFBlocks(), inserted")
+	require.Equal(1, n)
+
+	for _, fb := range fbs {
+		saved, err := SelectFBlockByHeight(conn, fb.Height)
+		if fb.Height == tip.Height {
+			require.NoError(err, "SelectFBlockByHeight()")
+		} else {
+			require.True(errors.Is(err, ErrPrunedFBlock),
+				"SelectFBlockByHeight(), pruned: %v", err)
+			require.Empty(saved.Transactions)
+		}
+		require.Equal(fb.Height, saved.Height)
+		require.Equal(*fb.KeyMR, *saved.KeyMR)
+		require.Equal(*fb.PrevKeyMR, *saved.PrevKeyMR)
+		require.Equal(fb.Timestamp.Unix(), saved.Timestamp.Unix())
+
+		for _, tx := range fb.Transactions {
+			saved, err := SelectTransactionByHash(conn, tx.ID)
+			require.NoError(err, "SelectTransactionByHash()")
+			require.Equal(*tx.ID, *saved.ID)
+			require.Equal(tx.Timestamp.Unix(), saved.Timestamp.Unix())
+			require.Equal(tx.TimestampSalt, saved.TimestampSalt)
+			require.Equal(tx.FCTInputs, saved.FCTInputs)
+			require.Equal(tx.FCTOutputs, saved.FCTOutputs)
+			require.Equal(tx.ECOutputs, saved.ECOutputs)
+			require.Equal(tx.TotalIn, saved.TotalIn)
+			require.Equal(tx.TotalFCTOut, saved.TotalFCTOut)
+			require.Equal(tx.TotalECOut, saved.TotalECOut)
+			require.Equal(tx.TotalBurn, saved.TotalBurn)
+			if fb.Height != tip.Height {
+				require.Empty(saved.Signatures)
+			}
+		}
+	}
+
+	n, _, err = CompressFBlocks(conn, CompressionDeflate, log.Logger{})
+	require.NoError(err, "CompressFBlocks()")
+	require.Equal(1, n, "pruned FBlocks are not compressed")
+
+	path := filepath.Join(dir, "snapshot.tar.gz")
+	_, err = WriteSnapshot(conn, path)
+	require.NoError(err, "WriteSnapshot()")
+	snap, err := OpenSnapshot(path, log.Logger{})
+	require.NoError(err, "OpenSnapshot()")
+	defer snap.Close()
+	require.NoError(snap.Verify(), "Snapshot.Verify(), pruned")
+}
+
+func TestUnmarshalFBlockHeader(t *testing.T) {
+	require := require.New(t)
+
+	fb := fblockChain(t, 1)[0]
+	header, _, err := unmarshalFBlockHeader(fblockData)
+	require.NoError(err, "unmarshalFBlockHeader()")
+	require.Equal(*fb.KeyMR, *header.KeyMR)
+	require.Equal(fb.Height, header.Height)
+
+	data := append([]byte(nil), fblockData...)
+	data[31] = 0x0c
+	_, _, err = unmarshalFBlockHeader(data)
+	require.EqualError(err, "invalid factoid chainid")
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// CreateTableScannedRange is the SQL that creates the "scanned_range" table
+// which tracks the contiguous ranges of heights saved in "fblock". A database
+// created with a start height, or with a partially completed backfill, has
+// gaps between these ranges.
+const CreateTableScannedRange = `CREATE TABLE "scanned_range" (
+        "start" INTEGER PRIMARY KEY, -- first "fblock"."height" in the range
+        "end" INT NOT NULL UNIQUE    -- last "fblock"."height" in the range
+);
+`
+
+// populateScannedRange fills "scanned_range" from the heights in "fblock".
+const populateScannedRange = `INSERT INTO "scanned_range" ("start", "end")
+        SELECT min("height"), max("height") FROM (
+                SELECT "height",
+                        "height" - row_number() OVER (ORDER BY "height")
+                        AS "island"
+                FROM "fblock")
+        GROUP BY "island";
+`
+
+// Range is an inclusive range of heights.
+type Range struct {
+	Start, End uint32
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%v-%v", r.Start, r.End)
+}
+
+// Len returns the number of heights in r.
+func (r Range) Len() int64 {
+	return int64(r.End) - int64(r.Start) + 1
+}
+
+// insertScannedHeight adds height to "scanned_range", extending or merging
+// any adjacent ranges.
+func insertScannedHeight(conn *sqlite.Conn, height uint32) (err error) {
+	defer sqlitex.Save(conn)(&err)
+
+	// Extend the range ending just before height, or start a new one.
+	extend := conn.Prep(`UPDATE "scanned_range" SET "end" = $height
+                WHERE "end" = $height - 1;`)
+	defer extend.Reset()
+	extend.SetInt64("$height", int64(height))
+	if _, err = extend.Step(); err != nil {
+		return
+	}
+	if conn.Changes() == 0 {
+		insert := conn.Prep(`INSERT INTO "scanned_range" ("start", "end")
+                        VALUES ($height, $height);`)
+		defer insert.Reset()
+		insert.SetInt64("$height", int64(height))
+		if _, err = insert.Step(); err != nil {
+			return
+		}
+	}
+
+	// Merge with the range starting just after height, if any.
+	next := conn.Prep(`SELECT "end" FROM "scanned_range"
+                WHERE "start" = $height + 1;`)
+	defer next.Reset()
+	next.SetInt64("$height", int64(height))
+	hasRow, err := next.Step()
+	if err != nil || !hasRow {
+		return
+	}
+	end := next.ColumnInt64(0)
+	next.Reset()
+
+	del := conn.Prep(`DELETE FROM "scanned_range" WHERE "start" = $height + 1;`)
+	defer del.Reset()
+	del.SetInt64("$height", int64(height))
+	if _, err = del.Step(); err != nil {
+		return
+	}
+	merge := conn.Prep(`UPDATE "scanned_range" SET "end" = $end
+                WHERE "end" = $height;`)
+	defer merge.Reset()
+	merge.SetInt64("$end", end)
+	merge.SetInt64("$height", int64(height))
+	_, err = merge.Step()
+	return
+}
+
+// SelectScannedRanges returns all ranges of saved heights in ascending
+// order.
+func SelectScannedRanges(conn *sqlite.Conn) ([]Range, error) {
+	var ranges []Range
+	err := sqlitex.Exec(conn, `SELECT "start", "end" FROM "scanned_range"
+                ORDER BY "start";`,
+		func(stmt *sqlite.Stmt) error {
+			ranges = append(ranges, Range{
+				Start: uint32(stmt.ColumnInt64(0)),
+				End:   uint32(stmt.ColumnInt64(1))})
+			return nil
+		})
+	return ranges, err
+}
+
+// SelectUnscannedRanges returns the ranges of heights between from and to,
+// inclusive, which have not been saved, in ascending order.
+func SelectUnscannedRanges(conn *sqlite.Conn, from, to uint32) ([]Range, error) {
+	scanned, err := SelectScannedRanges(conn)
+	if err != nil {
+		return nil, err
+	}
+	return unscanned(scanned, from, to), nil
+}
+
+func unscanned(scanned []Range, from, to uint32) []Range {
+	var gaps []Range
+	next := int64(from)
+	for _, r := range scanned {
+		if int64(r.Start) > next && next <= int64(to) {
+			end := int64(r.Start) - 1
+			if end > int64(to) {
+				end = int64(to)
+			}
+			gaps = append(gaps, Range{uint32(next), uint32(end)})
+		}
+		if int64(r.End)+1 > next {
+			next = int64(r.End) + 1
+		}
+	}
+	if next <= int64(to) {
+		gaps = append(gaps, Range{uint32(next), to})
+	}
+	return gaps
+}
+
+// UnscannedError is returned by CheckScanned when a range of heights
+// includes heights which have not been saved.
+type UnscannedError []Range
+
+func (err UnscannedError) Error() string {
+	return fmt.Sprintf("unscanned heights: %v", []Range(err))
+}
+
+// CheckScanned returns an UnscannedError if any of the heights from to to,
+// inclusive, have not been saved. Queries which aggregate over a range of
+// heights, such as address balances, are incomplete if this returns an
+// error.
+func CheckScanned(conn *sqlite.Conn, from, to uint32) error {
+	gaps, err := SelectUnscannedRanges(conn, from, to)
+	if err != nil {
+		return err
+	}
+	if len(gaps) > 0 {
+		return UnscannedError(gaps)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"github.com/canonical-ledgers/fblock-scan/log"
 )
 
 // For the sake of simplicity, all chain DBs use the exact same schema,
@@ -12,67 +13,209 @@ import (
 const dbSchema = CreateTableFBlock +
 	CreateTableAddress +
 	CreateTableTransaction +
-	CreateTableAddressTransaction
+	CreateTableAddressTransaction +
+	CreateTableWebhookDelivery +
+	CreateTableScannedRange +
+	CreateIndexTransactionHeight +
+	CreateTableTxIO
 
-var currentDBVersion = len(migrations) + 1
+var currentDBVersion = int64(len(migrations) + 1)
 
-var migrations = []func(*sqlite.Conn) error{
-	func(conn *sqlite.Conn) error {
-		return nil
+// migration upgrades the schema of a database by one version.
+type migration struct {
+	name string
+	up   func(*sqlite.Conn) error
+}
+
+// migrations are applied in order. A database at version v has had the first
+// v-1 migrations applied. New migrations must only be appended, and dbSchema
+// must be updated to match.
+var migrations = []migration{{
+	name: "no-op",
+	up:   func(conn *sqlite.Conn) error { return nil },
+}, {
+	name: "add webhook_delivery",
+	up: func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn, CreateTableWebhookDelivery)
+	},
+}, {
+	name: "add scanned_range",
+	up: func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn,
+			CreateTableScannedRange+populateScannedRange)
+	},
+}, {
+	name: "add fblock compression",
+	up: func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn, `ALTER TABLE "fblock"
+                        ADD COLUMN "compression" INT NOT NULL DEFAULT 0;`)
+	},
+}, {
+	name: "add pruning",
+	up: func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn, `ALTER TABLE "fblock"
+                        ADD COLUMN "pruned" INT NOT NULL DEFAULT 0;
+                ALTER TABLE "transaction" ADD COLUMN "ledger" BLOB;
+                `+CreateIndexTransactionHeight)
+	},
+}, {
+	name: "add tx_io",
+	up: func(conn *sqlite.Conn) error {
+		if err := sqlitex.ExecScript(conn, CreateTableTxIO); err != nil {
+			return err
+		}
+		return populateTxIO(conn)
+	},
+}, {
+	name: "add fees",
+	up: func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn, `ALTER TABLE "transaction"
+                        ADD COLUMN "fee" INT NOT NULL DEFAULT 0;
+                ALTER TABLE "transaction"
+                        ADD COLUMN "fee_ec" INT NOT NULL DEFAULT 0;
+                ALTER TABLE "fblock"
+                        ADD COLUMN "total_fee" INT NOT NULL DEFAULT 0;
+                ALTER TABLE "fblock"
+                        ADD COLUMN "total_fee_ec" INT NOT NULL DEFAULT 0;
+                `+populateFees)
 	},
+}, {
+	name: "add transaction type",
+	up: func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn, `ALTER TABLE "transaction"
+                        ADD COLUMN "type" INT NOT NULL DEFAULT 0;
+                ALTER TABLE "address_transaction"
+                        ADD COLUMN "reward" INT NOT NULL DEFAULT 0;
+                `+populateTxType)
+	},
+}}
+
+// Migration describes a step which upgrades the schema of a database from
+// version From to To.
+type Migration struct {
+	From, To int64
+	Name     string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%v -> %v: %v", m.From, m.To, m.Name)
 }
 
-func applyMigrations(conn *sqlite.Conn) (err error) {
-	empty, err := isEmpty(conn)
+// PendingMigrations returns the Migrations which Migrate would apply to conn,
+// in order, without modifying the database. An empty database is created at
+// the current version in a single step from version 0.
+func PendingMigrations(conn *sqlite.Conn) ([]Migration, error) {
+	if err := checkApplicationID(conn); err != nil {
+		return nil, err
+	}
+	empty, err := IsEmpty(conn)
 	if err != nil {
-		return
+		return nil, err
 	}
 	if empty {
-		if err = sqlitex.ExecScript(conn, dbSchema); err != nil {
-			return
-		}
-		return updateDBVersion(conn)
+		return []Migration{{0, currentDBVersion, "create schema"}}, nil
 	}
 
 	version, err := getDBVersion(conn)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if int(version)-1 == len(migrations) {
-		return nil
+	if version < 1 || version > currentDBVersion {
+		return nil, fmt.Errorf("no migration exists for DB version: %v",
+			version)
 	}
-	if int(version)-1 > len(migrations) {
-		return fmt.Errorf("no migration exists for DB version: %v", version)
+	var pending []Migration
+	for i, m := range migrations[version-1:] {
+		from := version + int64(i)
+		pending = append(pending, Migration{from, from + 1, m.name})
 	}
+	return pending, nil
+}
 
-	// Always VACUUM after a successful migration.
-	defer func() {
-		if err != nil {
+// Migrate applies any pending migrations to conn, in a single transaction,
+// and then VACUUMs the database. If backup is true, a file database is first
+// copied to a backup file named after the database and its version, such as
+// "fblock-scan.sqlite3.v2.bak", and the path is logged.
+func Migrate(conn *sqlite.Conn, log log.Logger, backup bool) (err error) {
+	pending, err := PendingMigrations(conn)
+	if err != nil || len(pending) == 0 {
+		return
+	}
+	if pending[0].From == 0 {
+		if err = sqlitex.ExecScript(conn, dbSchema); err != nil {
 			return
 		}
-		stmt, _, err := conn.PrepareTransient(`VACUUM;`)
+		return updateDBVersion(conn)
+	}
+
+	if backup {
+		path, err := backupDB(conn, pending[0].From)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("backup: %w", err)
 		}
-		defer stmt.Finalize()
-		if _, err := stmt.Step(); err != nil {
-			panic(err)
+		if path != "" {
+			log.Info("database backed up before migrating",
+				"path", path)
 		}
-	}()
+	}
 
-	defer sqlitex.Save(conn)(&err)
+	if err = applyMigrations(conn, log, pending); err != nil {
+		return
+	}
 
-	for i, migration := range migrations[version:] {
-		version := int(version) + i
-		fmt.Printf("running migration: %v -> %v\n", version, version+1)
-		if err = migration(conn); err != nil {
-			return
+	// Always VACUUM after a successful migration.
+	return Vacuum(conn)
+}
+
+// Vacuum rebuilds the database, which shrinks the file to the size of its
+// data. It cannot be called within a transaction.
+func Vacuum(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecTransient(conn, `VACUUM;`, nil); err != nil {
+		return fmt.Errorf("VACUUM: %w", err)
+	}
+	return nil
+}
+
+func applyMigrations(conn *sqlite.Conn, log log.Logger,
+	pending []Migration) (err error) {
+	defer sqlitex.Save(conn)(&err)
+	for _, m := range pending {
+		log.Info("running migration",
+			"from", m.From, "to", m.To, "name", m.Name)
+		if err = migrations[m.From-1].up(conn); err != nil {
+			return fmt.Errorf("migration %v: %w", m, err)
 		}
 	}
 	return updateDBVersion(conn)
 }
 
-func isEmpty(conn *sqlite.Conn) (bool, error) {
+// backupDB copies the database of conn at version to a backup file, and
+// returns its path. An in-memory database is not backed up, and the path is
+// empty.
+func backupDB(conn *sqlite.Conn, version int64) (string, error) {
+	var file string
+	if err := sqlitex.ExecTransient(conn,
+		`SELECT "file" FROM pragma_database_list WHERE "name" = 'main';`,
+		func(stmt *sqlite.Stmt) error {
+			file = stmt.ColumnText(0)
+			return nil
+		}); err != nil {
+		return "", err
+	}
+	if file == "" {
+		return "", nil
+	}
+	path := fmt.Sprintf("%v.v%v.bak", file, version)
+	dst, err := conn.BackupToDB("", path)
+	if err != nil {
+		return "", err
+	}
+	return path, dst.Close()
+}
+
+// IsEmpty returns true if the database of conn has no schema, such as a new
+// database file.
+func IsEmpty(conn *sqlite.Conn) (bool, error) {
 	var count int
 	err := sqlitex.ExecTransient(conn, `SELECT count(*) from "sqlite_master";`,
 		func(stmt *sqlite.Stmt) error {
@@ -82,7 +225,26 @@ func isEmpty(conn *sqlite.Conn) (bool, error) {
 	return count == 0, err
 }
 
+// bulkLoadFlag is set in PRAGMA user_version, above the schema version,
+// while a bulk load in speed mode is in progress. See Setup.
+const bulkLoadFlag = 1 << 30
+
 func getDBVersion(conn *sqlite.Conn) (int64, error) {
+	version, err := selectUserVersion(conn)
+	return version &^ bulkLoadFlag, err
+}
+
+// updateDBVersion sets the schema version to currentDBVersion, keeping the
+// bulkLoadFlag.
+func updateDBVersion(conn *sqlite.Conn) error {
+	version, err := selectUserVersion(conn)
+	if err != nil {
+		return err
+	}
+	return setUserVersion(conn, version&bulkLoadFlag|currentDBVersion)
+}
+
+func selectUserVersion(conn *sqlite.Conn) (int64, error) {
 	var version int64
 	err := sqlitex.ExecTransient(conn, `PRAGMA user_version;`,
 		func(stmt *sqlite.Stmt) error {
@@ -92,7 +254,7 @@ func getDBVersion(conn *sqlite.Conn) (int64, error) {
 	return version, err
 }
 
-func updateDBVersion(conn *sqlite.Conn) error {
+func setUserVersion(conn *sqlite.Conn, version int64) error {
 	return sqlitex.ExecScript(conn, fmt.Sprintf(`PRAGMA user_version = %v;`,
-		currentDBVersion))
+		version))
 }
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// TestMigrations checks that a new database, and a database at every old
+// version, has the schema in testdata/schema.golden after Setup.
+//
+// The schema of each old version is in testdata/v<version>.sql. Before adding
+// a migration, save the schema of a new database, as printed by the sqlite3
+// .schema command, as the old version, and then run the tests with -update.
+func TestMigrations(t *testing.T) {
+	require := require.New(t)
+
+	golden := filepath.Join("testdata", "schema.golden")
+	conn := openMemory(t)
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+	schema := dumpSchema(t, conn)
+	if *update {
+		require.NoError(ioutil.WriteFile(golden, []byte(schema), 0644))
+	}
+	want, err := ioutil.ReadFile(golden)
+	require.NoError(err)
+	require.Equal(string(want), schema, "new database")
+
+	pending, err := PendingMigrations(conn)
+	require.NoError(err, "PendingMigrations()")
+	require.Empty(pending, "new database")
+
+	for version := int64(1); version < currentDBVersion; version++ {
+		conn := openOldVersion(t, ":memory:", version)
+
+		pending, err := PendingMigrations(conn)
+		require.NoError(err, "PendingMigrations() v%v", version)
+		require.Len(pending, int(currentDBVersion-version))
+		require.Equal(version, pending[0].From)
+		require.Equal(currentDBVersion, pending[len(pending)-1].To)
+
+		require.NoError(Setup(conn, false, log.Logger{}),
+			"Setup() v%v", version)
+		require.Equal(string(want), dumpSchema(t, conn),
+			"migrated from v%v", version)
+		v, err := getDBVersion(conn)
+		require.NoError(err)
+		require.Equal(currentDBVersion, v)
+	}
+}
+
+func TestMigrateBackup(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.sqlite3")
+	conn := openOldVersion(t, path, 1)
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+
+	backup, err := sqlite.OpenConn(path+".v1.bak", sqlite.SQLITE_OPEN_READONLY)
+	require.NoError(err, "backup not found")
+	defer backup.Close()
+	version, err := getDBVersion(backup)
+	require.NoError(err)
+	require.EqualValues(1, version)
+
+	// No backup is made when there is nothing to migrate.
+	require.NoError(os.Remove(path + ".v1.bak"))
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+	_, err = os.Stat(path + fmt.Sprintf(".v%v.bak", currentDBVersion))
+	require.True(os.IsNotExist(err))
+}
+
+func TestPendingMigrationsInvalidVersion(t *testing.T) {
+	conn := openOldVersion(t, ":memory:", 1)
+	require.NoError(t, sqlitex.ExecScript(conn, fmt.Sprintf(
+		`PRAGMA user_version = %v;`, currentDBVersion+1)))
+	_, err := PendingMigrations(conn)
+	require.Error(t, err)
+	require.Error(t, Setup(conn, false, log.Logger{}))
+}
+
+// TestPopulate checks that the migrations which derive data from existing
+// rows populate the same data as InsertFBlock, from both full and pruned
+// FBlocks. The feature specific checks are with each feature's tests.
+func TestPopulate(t *testing.T) {
+	execScript := func(script string) func(*sqlite.Conn) error {
+		return func(conn *sqlite.Conn) error {
+			return sqlitex.ExecScript(conn, script)
+		}
+	}
+	for _, test := range []struct {
+		name     string
+		fbs      []factom.FBlock
+		clear    string // SQL which removes the derived data
+		populate func(*sqlite.Conn) error
+		check    func(*require.Assertions, *sqlite.Conn,
+			[]factom.FBlock, string)
+	}{{
+		name:     "tx_io",
+		fbs:      fblockChain(t, 3),
+		clear:    `DELETE FROM "tx_io";`,
+		populate: populateTxIO,
+		check:    checkTxIO,
+	}, {
+		name: "fees",
+		fbs:  fblockChain(t, 3),
+		clear: `UPDATE "transaction" SET "fee" = 0, "fee_ec" = 0;
+                        UPDATE "fblock" SET "total_fee" = 0, "total_fee_ec" = 0;`,
+		populate: execScript(populateFees),
+		check:    checkFees,
+	}, {
+		name: "transaction type",
+		fbs:  rewardChain(t),
+		clear: `UPDATE "transaction" SET "type" = 0;
+                        UPDATE "address_transaction" SET "reward" = 0;`,
+		populate: execScript(populateTxType),
+		check:    checkTxType,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			require := require.New(t)
+			conn := openMemory(t)
+			require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+
+			// The first FBlock is pruned, and the rest alternate
+			// compression.
+			for i, fb := range test.fbs {
+				require.NoError(InsertFBlock(conn, fb, 0,
+					Compression(i%2), nil), "InsertFBlock()")
+			}
+			_, err := PruneFBlocks(conn, 0, test.fbs[1].Height,
+				log.Logger{})
+			require.NoError(err, "PruneFBlocks()")
+			test.check(require, conn, test.fbs, "inserted")
+
+			require.NoError(sqlitex.ExecScript(conn, test.clear))
+			require.NoError(test.populate(conn), "populate")
+			test.check(require, conn, test.fbs, "populated")
+		})
+	}
+}
+
+func openMemory(t *testing.T) *sqlite.Conn {
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(t, err, "sqlite.OpenConn()")
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// openOldVersion opens a database at path with the schema from
+// testdata/v<version>.sql.
+func openOldVersion(t *testing.T, path string, version int64) *sqlite.Conn {
+	conn, err := sqlite.OpenConn(path, 0)
+	require.NoError(t, err, "sqlite.OpenConn()")
+	t.Cleanup(func() { conn.Close() })
+
+	sql, err := ioutil.ReadFile(filepath.Join("testdata",
+		fmt.Sprintf("v%v.sql", version)))
+	require.NoError(t, err)
+	require.NoError(t, sqlitex.ExecScript(conn, string(sql)+fmt.Sprintf(
+		`PRAGMA user_version = %v; PRAGMA application_id = %v;`,
+		version, ApplicationID)), "v%v.sql", version)
+	return conn
+}
+
+// dumpSchema returns the columns, indexes and foreign keys of every table
+// in conn, as reported by PRAGMA table_info, index_list, index_info and
+// foreign_key_list. Unlike the SQL in sqlite_master, these do not depend on
+// whether a column was created with the table or added by ALTER TABLE.
+func dumpSchema(t *testing.T, conn *sqlite.Conn) string {
+	var tables []string
+	require.NoError(t, sqlitex.Exec(conn, `SELECT "name" FROM "sqlite_master"
+                WHERE "type" = 'table' ORDER BY "name";`,
+		func(stmt *sqlite.Stmt) error {
+			tables = append(tables, stmt.ColumnText(0))
+			return nil
+		}))
+
+	var schema strings.Builder
+	for _, table := range tables {
+		fmt.Fprintf(&schema, "-- table %q\n", table)
+		require.NoError(t, sqlitex.Exec(conn, `SELECT "name", "type",
+                        "notnull", ifnull("dflt_value", 'NULL'), "pk"
+                        FROM pragma_table_info(?) ORDER BY "cid";`,
+			func(stmt *sqlite.Stmt) error {
+				fmt.Fprintf(&schema,
+					"column %q %v notnull=%v default=%v pk=%v\n",
+					stmt.ColumnText(0), stmt.ColumnText(1),
+					stmt.ColumnInt64(2), stmt.ColumnText(3),
+					stmt.ColumnInt64(4))
+				return nil
+			}, table))
+
+		var indexes []string
+		require.NoError(t, sqlitex.Exec(conn, `SELECT "name", "unique",
+                        "origin", "partial" FROM pragma_index_list(?)
+                        ORDER BY "name";`,
+			func(stmt *sqlite.Stmt) error {
+				indexes = append(indexes, stmt.ColumnText(0))
+				fmt.Fprintf(&schema,
+					"index %q unique=%v origin=%v partial=%v\n",
+					stmt.ColumnText(0), stmt.ColumnInt64(1),
+					stmt.ColumnText(2), stmt.ColumnInt64(3))
+				return nil
+			}, table))
+		for _, index := range indexes {
+			require.NoError(t, sqlitex.Exec(conn, `SELECT "name"
+                                FROM pragma_index_info(?) ORDER BY "seqno";`,
+				func(stmt *sqlite.Stmt) error {
+					fmt.Fprintf(&schema, "index %q column %q\n",
+						index, stmt.ColumnText(0))
+					return nil
+				}, index))
+		}
+
+		require.NoError(t, sqlitex.Exec(conn, `SELECT "id", "seq", "table",
+                        "from", "to", "on_update", "on_delete"
+                        FROM pragma_foreign_key_list(?)
+                        ORDER BY "id", "seq";`,
+			func(stmt *sqlite.Stmt) error {
+				fmt.Fprintf(&schema, "foreign key %v.%v %q -> %q(%q) "+
+					"on update %v on delete %v\n",
+					stmt.ColumnInt64(0), stmt.ColumnInt64(1),
+					stmt.ColumnText(3), stmt.ColumnText(2),
+					stmt.ColumnText(4), stmt.ColumnText(5),
+					stmt.ColumnText(6))
+				return nil
+			}, table))
+		schema.WriteString("\n")
+	}
+	return schema.String()
+}
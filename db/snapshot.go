@@ -0,0 +1,506 @@
+package db
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
+)
+
+// Snapshot is a database extracted from a snapshot written by WriteSnapshot,
+// which may be verified and then restored into a new database.
+type Snapshot struct {
+	Manifest Manifest
+
+	conn *sqlite.Conn
+	dir  string
+}
+
+// OpenSnapshot extracts the snapshot at path to a temporary directory and
+// checks the database file against the Manifest. Any pending migrations are
+// applied to the extracted database, with progress written to log.
+//
+// The Snapshot must be closed to remove the temporary directory.
+func OpenSnapshot(path string, log log.Logger) (_ *Snapshot, err error) {
+	dir, err := ioutil.TempDir("", "fblock-scan-snapshot")
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{dir: dir}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	dbPath := filepath.Join(dir, snapshotDB)
+	if s.Manifest, err = readSnapshot(path, dbPath); err != nil {
+		return nil, err
+	}
+
+	if s.conn, err = sqlite.OpenConn(dbPath, 0); err != nil {
+		return nil, err
+	}
+	appID, err := selectApplicationID(s.conn)
+	if err != nil {
+		return nil, err
+	}
+	if appID != ApplicationID {
+		return nil, fmt.Errorf("invalid snapshot: application_id")
+	}
+	if err := Migrate(s.conn, log, false); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readSnapshot extracts the database of the snapshot at path to dbPath, and
+// returns its Manifest.
+func readSnapshot(path, dbPath string) (Manifest, error) {
+	var m Manifest
+	f, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return m, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return m, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if hdr.Name != snapshotManifest {
+		return m, fmt.Errorf("invalid snapshot: expected %q but got %q",
+			snapshotManifest, hdr.Name)
+	}
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return m, fmt.Errorf("invalid snapshot manifest: %w", err)
+	}
+	if m.Format != SnapshotFormat {
+		return m, fmt.Errorf("unsupported snapshot format: %v", m.Format)
+	}
+	if m.SchemaVersion > currentDBVersion {
+		return m, fmt.Errorf(
+			"snapshot schema version %v is newer than supported version %v",
+			m.SchemaVersion, currentDBVersion)
+	}
+
+	hdr, err = tr.Next()
+	if err != nil {
+		return m, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if hdr.Name != snapshotDB {
+		return m, fmt.Errorf("invalid snapshot: expected %q but got %q",
+			snapshotDB, hdr.Name)
+	}
+	if hdr.Size != m.Size {
+		return m, fmt.Errorf("invalid snapshot: size %v, expected %v",
+			hdr.Size, m.Size)
+	}
+
+	db, err := os.Create(dbPath)
+	if err != nil {
+		return m, err
+	}
+	defer db.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(db, hash), tr); err != nil {
+		return m, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != m.SHA256 {
+		return m, fmt.Errorf("invalid snapshot: SHA256 %v, expected %v",
+			sum, m.SHA256)
+	}
+	return m, db.Close()
+}
+
+// Verify checks the integrity of the snapshot database, and that every saved
+// FBlock has its saved KeyMR and height, and links to the previous FBlock
+// within its scanned range. The latest FBlock must match the Manifest.
+//
+// This proves that each scanned range is a valid chain of FBlocks, but only
+// if the KeyMR of the last FBlock of each range is checked against factomd.
+// See Ranges and KeyMR.
+//
+// The tables derived from the FBlocks are also recomputed and compared: the
+// Transactions of each FBlock, their inputs and outputs, their amounts per
+// address, and the address balances.
+func (s *Snapshot) Verify() error {
+	if err := quickCheck(s.conn); err != nil {
+		return err
+	}
+	if err := foreignKeyCheck(s.conn); err != nil {
+		return err
+	}
+
+	scanned, err := s.Ranges()
+	if err != nil {
+		return err
+	}
+	chain, tip, err := verifyChain(s.conn)
+	if err != nil {
+		return err
+	}
+	if len(chain) != len(scanned) {
+		return fmt.Errorf("scanned ranges %v do not match FBlocks %v",
+			scanned, chain)
+	}
+	for i := range chain {
+		if chain[i] != scanned[i] {
+			return fmt.Errorf("scanned ranges %v do not match FBlocks %v",
+				scanned, chain)
+		}
+	}
+	if len(chain) == 0 {
+		return fmt.Errorf("database is empty")
+	}
+
+	if height := chain[len(chain)-1].End; height != s.Manifest.SyncHeight {
+		return fmt.Errorf("sync height %v, expected %v",
+			height, s.Manifest.SyncHeight)
+	}
+	if tip.String() != s.Manifest.TipKeyMR {
+		return fmt.Errorf("tip KeyMR %v, expected %v",
+			tip, s.Manifest.TipKeyMR)
+	}
+	return verifyBalances(s.conn)
+}
+
+// verifyChain checks every saved FBlock and its Transactions in order of
+// height, and returns the contiguous ranges of saved heights and the KeyMR of
+// the latest FBlock.
+func verifyChain(conn *sqlite.Conn) ([]Range, factom.Bytes32, error) {
+	var chain []Range
+	var prevKeyMR factom.Bytes32
+	stmt := conn.Prep(`SELECT "data", "timestamp", "compression", "pruned",
+                "height", "key_mr" FROM "fblock" ORDER BY "height";`)
+	defer stmt.Reset()
+	for {
+		// selectFBlock steps stmt, so each call reads the next row.
+		fb, err := selectFBlock(stmt)
+		if errors.Is(err, ErrNoFBlock) {
+			return chain, prevKeyMR, nil
+		}
+		height := uint32(stmt.ColumnInt64(4))
+		// The KeyMR of a pruned FBlock is computed from its header.
+		if err != nil && !errors.Is(err, ErrPrunedFBlock) {
+			return nil, prevKeyMR, fmt.Errorf("FBlock %v: %w", height, err)
+		}
+		var keyMR factom.Bytes32
+		stmt.ColumnBytes(5, keyMR[:])
+
+		if fb.Height != height {
+			return nil, prevKeyMR, fmt.Errorf(
+				"FBlock %v: saved with height %v", fb.Height, height)
+		}
+		if *fb.KeyMR != keyMR {
+			return nil, prevKeyMR, fmt.Errorf(
+				"FBlock %v: KeyMR %v, saved with %v",
+				height, fb.KeyMR, keyMR)
+		}
+		if err := verifyTransactions(conn, fb,
+			errors.Is(err, ErrPrunedFBlock)); err != nil {
+			return nil, prevKeyMR, fmt.Errorf("FBlock %v: %w", height, err)
+		}
+		if n := len(chain); n > 0 && chain[n-1].End+1 == height {
+			if *fb.PrevKeyMR != prevKeyMR {
+				return nil, prevKeyMR, fmt.Errorf(
+					"FBlock %v: PrevKeyMR %v, expected %v",
+					height, fb.PrevKeyMR, prevKeyMR)
+			}
+			chain[n-1].End = height
+		} else {
+			chain = append(chain, Range{Start: height, End: height})
+		}
+		prevKeyMR = keyMR
+	}
+}
+
+// savedTx is a "transaction" row.
+type savedTx struct {
+	ID        int64
+	Offset    int
+	Size      int
+	Timestamp int64
+	TotalIn   uint64
+	FCTOut    uint64
+	ECOut     uint64
+	Hash      factom.Bytes32
+	Fee       uint64
+	FeeEC     uint64
+	Type      TxType
+}
+
+// verifyTransactions checks that the saved Transactions at the height of fb,
+// and their "tx_io" and "address_transaction" rows, match the Transactions of
+// fb, and that the totals saved with fb match.
+//
+// The Transactions of a pruned FBlock are unmarshaled from their saved
+// ledger data instead, so only the ledger data is verified, against the
+// saved hash. Their offset, size and timestamp cannot be recomputed.
+//
+// The "address_transaction" rows of a Transaction may be missing entirely,
+// since they are only saved for Transactions involving a whitelisted
+// address, but otherwise must be complete.
+func verifyTransactions(conn *sqlite.Conn, fb factom.FBlock,
+	pruned bool) error {
+	stmt := conn.Prep(`SELECT "id", "fb_offset", "size", "timestamp",
+                "total_fct_in", "total_fct_out", "total_ec_out", "hash",
+                "fee", "fee_ec", "type", "ledger" FROM "transaction"
+                WHERE "height" = ? ORDER BY "fb_offset";`)
+	defer stmt.Reset()
+	stmt.BindInt64(sqlite.BindIndexStart, int64(fb.Height))
+	var saved []savedTx
+	var ledgers [][]byte
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			break
+		}
+		i := sqlite.ColumnIncrementor()
+		tx := savedTx{
+			ID:        stmt.ColumnInt64(i()),
+			Offset:    int(stmt.ColumnInt64(i())),
+			Size:      int(stmt.ColumnInt64(i())),
+			Timestamp: stmt.ColumnInt64(i()),
+			TotalIn:   uint64(stmt.ColumnInt64(i())),
+			FCTOut:    uint64(stmt.ColumnInt64(i())),
+			ECOut:     uint64(stmt.ColumnInt64(i())),
+		}
+		stmt.ColumnBytes(i(), tx.Hash[:])
+		tx.Fee = uint64(stmt.ColumnInt64(i()))
+		tx.FeeEC = uint64(stmt.ColumnInt64(i()))
+		tx.Type = TxType(stmt.ColumnInt64(i()))
+		col := i()
+		ledger := make([]byte, stmt.ColumnLen(col))
+		stmt.ColumnBytes(col, ledger)
+		saved = append(saved, tx)
+		ledgers = append(ledgers, ledger)
+	}
+
+	txs := fb.Transactions
+	var offsets []int
+	if pruned {
+		txs = make([]factom.Transaction, len(saved))
+		for i, ledger := range ledgers {
+			tx, _, err := unmarshalLedger(ledger)
+			if err != nil {
+				return fmt.Errorf("Transaction %v: ledger: %w",
+					saved[i].ID, err)
+			}
+			txs[i] = tx
+		}
+	} else {
+		offsets = txOffsets(fb)
+	}
+	if len(saved) != len(txs) {
+		return fmt.Errorf("%v Transactions saved, expected %v",
+			len(saved), len(txs))
+	}
+
+	var totalFee, totalFeeEC uint64
+	for i, tx := range txs {
+		fee := Fee(tx)
+		expected := savedTx{
+			ID:        saved[i].ID,
+			Offset:    saved[i].Offset,
+			Size:      saved[i].Size,
+			Timestamp: saved[i].Timestamp,
+			TotalIn:   tx.TotalIn,
+			FCTOut:    tx.TotalFCTOut,
+			ECOut:     tx.TotalECOut,
+			Hash:      *tx.ID,
+			Fee:       fee,
+			FeeEC:     FeeEC(fee, fb.ECExchangeRate),
+			Type:      transactionType(tx, i),
+		}
+		if !pruned {
+			expected.Offset = offsets[i]
+			expected.Size = tx.MarshalBinaryLen()
+			expected.Timestamp = tx.Timestamp.Unix()
+		}
+		if saved[i] != expected {
+			return fmt.Errorf("Transaction %v: saved as %+v, expected %+v",
+				tx.ID, saved[i], expected)
+		}
+		totalFee += expected.Fee
+		totalFeeEC += expected.FeeEC
+
+		if err := verifyTxIO(conn, tx, expected.ID); err != nil {
+			return fmt.Errorf("Transaction %v: %w", tx.ID, err)
+		}
+		if err := verifyAddressTransactions(conn, tx, expected.ID,
+			expected.Type == TxTypeCoinbase); err != nil {
+			return fmt.Errorf("Transaction %v: %w", tx.ID, err)
+		}
+	}
+
+	stmt = conn.Prep(`SELECT "tx_count", "total_fee", "total_fee_ec"
+                FROM "fblock" WHERE "height" = ?;`)
+	defer stmt.Reset()
+	stmt.BindInt64(sqlite.BindIndexStart, int64(fb.Height))
+	if _, err := stmt.Step(); err != nil {
+		return err
+	}
+	if n := stmt.ColumnInt64(0); n != int64(len(txs)) {
+		return fmt.Errorf("tx_count %v, expected %v", n, len(txs))
+	}
+	if fee, feeEC := uint64(stmt.ColumnInt64(1)),
+		uint64(stmt.ColumnInt64(2)); fee != totalFee || feeEC != totalFeeEC {
+		return fmt.Errorf("total fees %v, %v EC, expected %v, %v EC",
+			fee, feeEC, totalFee, totalFeeEC)
+	}
+	return nil
+}
+
+// verifyTxIO checks that the saved "tx_io" rows of txID match tx.
+func verifyTxIO(conn *sqlite.Conn, tx factom.Transaction, txID int64) error {
+	saved, err := SelectTxIO(conn, txID)
+	if err != nil {
+		return err
+	}
+	expected := txIOs(tx)
+	if len(saved) != len(expected) {
+		return fmt.Errorf("%v inputs and outputs saved, expected %v",
+			len(saved), len(expected))
+	}
+	for i := range saved {
+		if saved[i] != expected[i] {
+			return fmt.Errorf("%v %v saved as %+v, expected %+v",
+				expected[i].Direction, expected[i].Index,
+				saved[i], expected[i])
+		}
+	}
+	return nil
+}
+
+// verifyAddressTransactions checks that the "address_transaction" rows of
+// txID, if any, have the net amount of each address of tx, and are flagged
+// as rewards if reward is true.
+func verifyAddressTransactions(conn *sqlite.Conn, tx factom.Transaction,
+	txID int64, reward bool) error {
+	expected := make(map[string]int64)
+	for _, adr := range tx.FCTInputs {
+		expected[adr.FAAddress().String()] -= int64(adr.Amount)
+	}
+	for _, adr := range tx.FCTOutputs {
+		expected[adr.FAAddress().String()] += int64(adr.Amount)
+	}
+
+	saved := make(map[string]int64)
+	if err := sqlitex.Exec(conn, `SELECT "a"."adr", "at"."amount",
+                "at"."reward" FROM "address_transaction" AS "at"
+                JOIN "address" AS "a" ON "a"."id" = "at"."adr_id"
+                WHERE "at"."tx_id" = ?;`,
+		func(stmt *sqlite.Stmt) error {
+			if (stmt.ColumnInt64(2) != 0) != reward {
+				return fmt.Errorf("%v: reward %v, expected %v",
+					stmt.ColumnText(0), !reward, reward)
+			}
+			saved[stmt.ColumnText(0)] = stmt.ColumnInt64(1)
+			return nil
+		}, txID); err != nil {
+		return err
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+	if len(saved) != len(expected) {
+		return fmt.Errorf("%v addresses saved, expected %v",
+			len(saved), len(expected))
+	}
+	for adr, amount := range expected {
+		if saved[adr] != amount {
+			return fmt.Errorf("%v: amount %v, expected %v",
+				adr, saved[adr], amount)
+		}
+	}
+	return nil
+}
+
+// verifyBalances checks that the balance of every address is the sum of its
+// "address_transaction" amounts.
+func verifyBalances(conn *sqlite.Conn) error {
+	var adr string
+	var balance, expected int64
+	err := sqlitex.Exec(conn, `SELECT "adr", "balance", (
+                        SELECT ifnull(sum("amount"), 0)
+                        FROM "address_transaction" WHERE "adr_id" = "id")
+                FROM "address" WHERE "balance" != (
+                        SELECT ifnull(sum("amount"), 0)
+                        FROM "address_transaction" WHERE "adr_id" = "id")
+                LIMIT 1;`,
+		func(stmt *sqlite.Stmt) error {
+			adr = stmt.ColumnText(0)
+			balance, expected = stmt.ColumnInt64(1), stmt.ColumnInt64(2)
+			return nil
+		})
+	if err != nil {
+		return err
+	}
+	if adr != "" {
+		return fmt.Errorf("address %v: balance %v, expected %v",
+			adr, balance, expected)
+	}
+	return nil
+}
+
+// Ranges returns the scanned ranges of the snapshot database.
+func (s *Snapshot) Ranges() ([]Range, error) {
+	return SelectScannedRanges(s.conn)
+}
+
+// KeyMR returns the KeyMR of the FBlock saved at height in the snapshot
+// database.
+func (s *Snapshot) KeyMR(height uint32) (factom.Bytes32, error) {
+	return SelectFBlockKeyMR(s.conn, height)
+}
+
+// Restore copies the snapshot database into the empty database of conn.
+func (s *Snapshot) Restore(conn *sqlite.Conn) error {
+	empty, err := IsEmpty(conn)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("database is not empty")
+	}
+	b, err := s.conn.BackupInit("", "", conn)
+	if err != nil {
+		return err
+	}
+	if err := b.Step(-1); err != nil {
+		b.Finish()
+		return err
+	}
+	return b.Finish()
+}
+
+// Close the snapshot database and remove its temporary directory. It is safe
+// to call Close more than once.
+func (s *Snapshot) Close() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fblockChain returns a chain of n FBlocks starting at the height of
+// fblockData, derived from it by rewriting the height and PrevKeyMR.
+func fblockChain(t testing.TB, n int) []factom.FBlock {
+	fbs := make([]factom.FBlock, n)
+	var prevKeyMR factom.Bytes32
+	for i := range fbs {
+		data := append(factom.Bytes(nil), fblockData...)
+		height := binary.BigEndian.Uint32(data[136:140]) + uint32(i)
+		if i > 0 {
+			copy(data[64:96], prevKeyMR[:])
+		}
+		binary.BigEndian.PutUint32(data[136:140], height)
+		require.NoError(t, fbs[i].UnmarshalBinary(data),
+			"factom.FBlock.UnmarshalBinary()")
+		prevKeyMR = *fbs[i].KeyMR
+	}
+	return fbs
+}
+
+func TestSnapshot(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	conn, err := sqlite.OpenConn(filepath.Join(dir, "src.sqlite3"), 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+	fbs := fblockChain(t, 3)
+	for _, fb := range fbs {
+		require.NoError(InsertFBlock(conn, fb, 0, CompressionNone, nil), "InsertFBlock()")
+	}
+	tip := fbs[len(fbs)-1]
+
+	path := filepath.Join(dir, "snapshot.tar.gz")
+	_, err = WriteSnapshot(conn, path)
+	require.NoError(err, "WriteSnapshot()")
+
+	snap, err := OpenSnapshot(path, log.Logger{})
+	require.NoError(err, "OpenSnapshot()")
+	defer snap.Close()
+	require.NoError(snap.Verify(), "Snapshot.Verify()")
+	ranges, err := snap.Ranges()
+	require.NoError(err)
+	require.Equal([]Range{{fbs[0].Height, tip.Height}}, ranges)
+	keyMR, err := snap.KeyMR(tip.Height)
+	require.NoError(err)
+	require.Equal(*tip.KeyMR, keyMR)
+
+	dst, err := sqlite.OpenConn(filepath.Join(dir, "dst.sqlite3"), 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer dst.Close()
+	require.NoError(snap.Restore(dst), "Snapshot.Restore()")
+	require.EqualError(snap.Restore(dst), "database is not empty")
+	require.NoError(Setup(dst, false, log.Logger{}), "Setup()")
+	height, err := SelectSyncHeight(dst)
+	require.NoError(err)
+	require.Equal(tip.Height, height)
+	require.NoError(snap.Close())
+	_, err = os.Stat(snap.dir)
+	require.True(os.IsNotExist(err), "temporary directory removed")
+
+	// A snapshot of a database with an invalid KeyMR must not verify.
+	stmt := conn.Prep(`UPDATE "fblock" SET "key_mr" = ? WHERE "height" = ?;`)
+	stmt.BindBytes(1, make([]byte, 32))
+	stmt.BindInt64(2, int64(fbs[1].Height))
+	_, err = stmt.Step()
+	require.NoError(err)
+	require.NoError(stmt.Reset())
+	_, err = WriteSnapshot(conn, path)
+	require.NoError(err, "WriteSnapshot()")
+	snap, err = OpenSnapshot(path, log.Logger{})
+	require.NoError(err, "OpenSnapshot()")
+	defer snap.Close()
+	require.Error(snap.Verify(), "Snapshot.Verify(), invalid KeyMR")
+}
+
+// TestSnapshotDerived checks that a snapshot does not verify if any of the
+// tables derived from its FBlocks do not match.
+func TestSnapshotDerived(t *testing.T) {
+	verify := func(sql string, prune bool) error {
+		dir := t.TempDir()
+		conn, err := sqlite.OpenConn(filepath.Join(dir, "src.sqlite3"), 0)
+		require.NoError(t, err, "sqlite.OpenConn()")
+		defer conn.Close()
+		require.NoError(t, Setup(conn, false, log.Logger{}), "Setup()")
+		fbs := fblockChain(t, 3)
+		for _, fb := range fbs {
+			require.NoError(t, InsertFBlock(conn, fb, 0,
+				CompressionNone, nil), "InsertFBlock()")
+		}
+		if prune {
+			_, err := PruneFBlocks(conn, 0, fbs[2].Height, log.Logger{})
+			require.NoError(t, err, "PruneFBlocks()")
+		}
+		require.NoError(t, sqlitex.ExecScript(conn, sql))
+
+		path := filepath.Join(dir, "snapshot.tar.gz")
+		_, err = WriteSnapshot(conn, path)
+		require.NoError(t, err, "WriteSnapshot()")
+		snap, err := OpenSnapshot(path, log.Logger{})
+		require.NoError(t, err, "OpenSnapshot()")
+		defer snap.Close()
+		return snap.Verify()
+	}
+	require.NoError(t, verify("", false), "Snapshot.Verify()")
+	require.NoError(t, verify("", true), "Snapshot.Verify(), pruned")
+
+	for _, sql := range []string{
+		`UPDATE "transaction" SET "total_fct_in" = "total_fct_in" + 1;`,
+		`UPDATE "transaction" SET "fee" = "fee" + 1;`,
+		`UPDATE "transaction" SET "type" = 2 WHERE "type" = 0;`,
+		`UPDATE "fblock" SET "total_fee" = "total_fee" + 1;`,
+		`UPDATE "tx_io" SET "amount" = "amount" + 1;`,
+		`UPDATE "address_transaction" SET "amount" = "amount" + 1;`,
+		`UPDATE "address_transaction" SET "reward" = NOT "reward";`,
+		`UPDATE "address" SET "balance" = "balance" + 1;`,
+	} {
+		require.Error(t, verify(sql, false), sql)
+		require.Error(t, verify(sql, true), sql)
+	}
+}
+
+func TestSnapshotManifest(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+
+	conn, err := sqlite.OpenConn(filepath.Join(dir, "src.sqlite3"), 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+	require.NoError(InsertFBlock(conn, fblockChain(t, 1)[0], 0, CompressionNone, nil),
+		"InsertFBlock()")
+
+	dbPath := filepath.Join(dir, "backup.sqlite3")
+	require.NoError(Backup(conn, dbPath), "Backup()")
+	m, err := newManifest(dbPath)
+	require.NoError(err, "newManifest()")
+
+	for _, test := range []struct {
+		name   string
+		modify func(*Manifest)
+		err    string
+	}{{
+		name:   "format",
+		modify: func(m *Manifest) { m.Format++ },
+		err:    "unsupported snapshot format: 2",
+	}, {
+		name:   "schema version",
+		modify: func(m *Manifest) { m.SchemaVersion = currentDBVersion + 1 },
+		err: fmt.Sprintf(
+			"snapshot schema version %v is newer than supported version %v",
+			currentDBVersion+1, currentDBVersion),
+	}, {
+		name:   "sha256",
+		modify: func(m *Manifest) { m.SHA256 = "00" },
+		err:    "invalid snapshot: SHA256 " + m.SHA256 + ", expected 00",
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			m := m
+			test.modify(&m)
+			path := filepath.Join(dir, "snapshot.tar.gz")
+			f, err := os.Create(path)
+			require.NoError(err)
+			require.NoError(writeSnapshot(f, m, dbPath), "writeSnapshot()")
+			require.NoError(f.Close())
+
+			_, err = OpenSnapshot(path, log.Logger{})
+			require.EqualError(err, test.err)
+		})
+	}
+}
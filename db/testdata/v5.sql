@@ -0,0 +1,69 @@
+CREATE TABLE "fblock"(
+        "height" INTEGER PRIMARY KEY,
+        "timestamp" INT NOT NULL,
+        "tx_count" INT NOT NULL,
+        "ec_exchange_rate" INT NOT NULL,
+        "price" REAL, -- Denoted in USD
+        "key_mr" BLOB NOT NULL,
+        "data" BLOB NOT NULL
+, "compression" INT NOT NULL DEFAULT 0);
+CREATE TABLE "address" (
+        "id"      INTEGER PRIMARY KEY,
+        "balance" INTEGER NOT NULL,
+        "adr"     TEXT NOT NULL UNIQUE,
+        "memo"    TEXT
+);
+CREATE TABLE "transaction" (
+        "id"      INTEGER PRIMARY KEY,
+
+        "height" INT NOT NULL,    -- "fblock"."height"
+
+        "fb_offset" INT NOT NULL, -- index of tx data within "fblock"."data"
+        "size" INT NOT NULL,      -- length of tx data in bytes
+
+        "timestamp" INT NOT NULL,
+
+        -- amounts
+        "total_fct_in"  INT NOT NULL, -- denoted in factoshis
+        "total_fct_out" INT NOT NULL, -- denoted in factoshis
+        "total_ec_out"  INT NOT NULL, -- denoted in factoshis
+
+        "hash" BLOB NOT NULL, -- hash of tx ledger data
+
+        "memo" TEXT,
+
+        FOREIGN KEY("height") REFERENCES "fblock"("height")
+);
+CREATE TABLE "address_transaction" (
+        "tx_id" INT NOT NULL,  -- "transaction"."id"
+        "adr_id" INT NOT NULL, -- "address"."id"
+
+        "amount" INT NOT NULL, -- may be negative, if input
+
+        PRIMARY KEY("tx_id", "adr_id"),
+
+        FOREIGN KEY("tx_id") REFERENCES "transaction"("id"),
+        FOREIGN KEY("adr_id") REFERENCES "address"("id")
+);
+CREATE TABLE "webhook_delivery" (
+        "id" INTEGER PRIMARY KEY,
+
+        "url" TEXT NOT NULL,
+        "tx_id" INT NOT NULL,  -- "transaction"."id"
+        "adr_id" INT NOT NULL, -- "address"."id"
+
+        "attempts" INT NOT NULL DEFAULT 0,
+        "next_attempt" INT NOT NULL DEFAULT 0, -- unix timestamp
+        "delivered" INT, -- unix timestamp, NULL until delivered
+
+        UNIQUE("url", "tx_id", "adr_id"),
+
+        FOREIGN KEY("tx_id") REFERENCES "transaction"("id"),
+        FOREIGN KEY("adr_id") REFERENCES "address"("id")
+);
+CREATE INDEX "idx_webhook_delivery_pending" ON "webhook_delivery"
+        ("next_attempt") WHERE "delivered" IS NULL;
+CREATE TABLE "scanned_range" (
+        "start" INTEGER PRIMARY KEY, -- first "fblock"."height" in the range
+        "end" INT NOT NULL UNIQUE    -- last "fblock"."height" in the range
+);
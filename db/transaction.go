@@ -2,6 +2,9 @@ package db
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
 
 	"crawshaw.io/sqlite"
 	"github.com/Factom-Asset-Tokens/factom"
@@ -27,6 +30,12 @@ const CreateTableTransaction = `CREATE TABLE "transaction" (
         "hash" BLOB NOT NULL, -- hash of tx ledger data
 
         "memo" TEXT,
+        "ledger" BLOB, -- tx ledger data, only if the FBlock is pruned
+
+        "fee" INT NOT NULL DEFAULT 0,    -- denoted in factoshis
+        "fee_ec" INT NOT NULL DEFAULT 0, -- denoted in Entry Credits
+
+        "type" INT NOT NULL DEFAULT 0, -- 0: normal, 1: coinbase, 2: EC purchase
 
         FOREIGN KEY("height") REFERENCES "fblock"("height")
 );
@@ -38,7 +47,8 @@ const CreateTableAddressTransaction = `CREATE TABLE "address_transaction" (
         "tx_id" INT NOT NULL,  -- "transaction"."id"
         "adr_id" INT NOT NULL, -- "address"."id"
 
-        "amount" INT NOT NULL, -- may be negative, if input
+        "amount" INT NOT NULL,           -- may be negative, if input
+        "reward" INT NOT NULL DEFAULT 0, -- 1 if paid by a coinbase tx
 
         PRIMARY KEY("tx_id", "adr_id"),
 
@@ -46,8 +56,61 @@ const CreateTableAddressTransaction = `CREATE TABLE "address_transaction" (
         FOREIGN KEY("adr_id") REFERENCES "address"("id")
 );`
 
+// TxType is the "transaction"."type".
+type TxType int
+
+const (
+	// TxTypeNormal is any Transaction which is not of another TxType.
+	TxTypeNormal TxType = iota
+	// TxTypeCoinbase is the first Transaction of every FBlock, which has
+	// no inputs and pays the authority server and grant rewards.
+	TxTypeCoinbase
+	// TxTypeECPurchase is a Transaction with only EC outputs.
+	TxTypeECPurchase
+)
+
+func (t TxType) String() string {
+	switch t {
+	case TxTypeNormal:
+		return "normal"
+	case TxTypeCoinbase:
+		return "coinbase"
+	case TxTypeECPurchase:
+		return "ec_purchase"
+	}
+	return fmt.Sprintf("TxType(%d)", int(t))
+}
+
+// transactionType returns the TxType of tx, the ith Transaction of its
+// FBlock.
+func transactionType(tx factom.Transaction, i int) TxType {
+	switch {
+	case i == 0:
+		return TxTypeCoinbase
+	case tx.TotalFCTOut == 0 && tx.TotalECOut > 0:
+		return TxTypeECPurchase
+	}
+	return TxTypeNormal
+}
+
+// populateTxType is the SQL that computes the "transaction"."type" of all
+// saved Transactions, and flags the "address_transaction" rows of coinbase
+// Transactions as rewards, in the same way as transactionType. The coinbase
+// Transaction is the first in its FBlock's data.
+const populateTxType = `UPDATE "transaction" SET "type" = CASE
+        WHEN "fb_offset" = (SELECT min("fb_offset") FROM "transaction" AS "t"
+                WHERE "t"."height" = "transaction"."height") THEN 1
+        WHEN "total_fct_out" = 0 AND "total_ec_out" > 0 THEN 2
+        ELSE 0 END;
+UPDATE "address_transaction" SET "reward" = 1 WHERE "tx_id" IN
+        (SELECT "id" FROM "transaction" WHERE "type" = 1);
+`
+
+// InsertTransaction saves tx of txType from the FBlock at height, with the
+// given ecRate, at fbOffset within the FBlock data, and returns its row id.
 func InsertTransaction(conn *sqlite.Conn, tx factom.Transaction,
-	height uint32, fbOffset int) (int64, error) {
+	height uint32, ecRate uint64, txType TxType,
+	fbOffset int) (int64, error) {
 
 	stmt := conn.Prep(`INSERT INTO "transaction" (
                 "height",
@@ -57,8 +120,11 @@ func InsertTransaction(conn *sqlite.Conn, tx factom.Transaction,
                 "timestamp",
                 "total_fct_in",
                 "total_fct_out",
-                "total_ec_out"
-                ) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`)
+                "total_ec_out",
+                "fee",
+                "fee_ec",
+                "type"
+                ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`)
 	defer stmt.Reset()
 
 	i := sqlite.BindIncrementor()
@@ -70,6 +136,10 @@ func InsertTransaction(conn *sqlite.Conn, tx factom.Transaction,
 	stmt.BindInt64(i(), int64(tx.TotalIn))
 	stmt.BindInt64(i(), int64(tx.TotalFCTOut))
 	stmt.BindInt64(i(), int64(tx.TotalECOut))
+	fee := Fee(tx)
+	stmt.BindInt64(i(), int64(fee))
+	stmt.BindInt64(i(), int64(FeeEC(fee, ecRate)))
+	stmt.BindInt64(i(), int64(txType))
 
 	_, err := stmt.Step()
 	if err != nil {
@@ -81,8 +151,10 @@ func InsertTransaction(conn *sqlite.Conn, tx factom.Transaction,
 
 var ignoreErr = fmt.Errorf("ignore")
 
-var selectTransactionWhere = `SELECT "height", "fb_offset", "size"
-        FROM "transaction" WHERE `
+var selectTransactionWhere = `SELECT "t"."height", "fb_offset", "size",
+        "compression", "pruned", "ledger", "t"."timestamp"
+        FROM "transaction" AS "t"
+        JOIN "fblock" AS "f" ON "t"."height" = "f"."height" WHERE `
 
 func SelectTransactionByHash(conn *sqlite.Conn,
 	txID *factom.Bytes32) (factom.Transaction, error) {
@@ -100,6 +172,29 @@ func SelectTransactionByID(conn *sqlite.Conn,
 	stmt.BindInt64(sqlite.BindIndexStart, rowID)
 	return selectTransaction(conn, stmt)
 }
+
+// SelectTransactionHeight returns the height of the FBlock of the Transaction
+// with txID, and whether the FBlock has been pruned, in which case only the
+// ledger data of the Transaction is saved.
+func SelectTransactionHeight(conn *sqlite.Conn,
+	txID *factom.Bytes32) (uint32, bool, error) {
+
+	stmt := conn.Prep(`SELECT "t"."height", "pruned" FROM "transaction" AS "t"
+                JOIN "fblock" AS "f" ON "t"."height" = "f"."height"
+                WHERE "hash" = ?;`)
+	defer stmt.Reset()
+	stmt.BindBytes(sqlite.BindIndexStart, txID[:])
+	hasRow, err := stmt.Step()
+	if err != nil {
+		return 0, false, err
+	}
+	if !hasRow {
+		return 0, false, fmt.Errorf("no Transaction found")
+	}
+	i := sqlite.ColumnIncrementor()
+	return uint32(stmt.ColumnInt64(i())), stmt.ColumnInt(i()) != 0, nil
+}
+
 func selectTransaction(conn *sqlite.Conn, stmt *sqlite.Stmt) (
 	factom.Transaction, error) {
 	var tx factom.Transaction
@@ -116,19 +211,49 @@ func selectTransaction(conn *sqlite.Conn, stmt *sqlite.Stmt) (
 	fblockID := stmt.ColumnInt64(i())
 	fbOffset := stmt.ColumnInt64(i())
 	size := int(stmt.ColumnInt64(i()))
+	compression := Compression(stmt.ColumnInt64(i()))
+	if stmt.ColumnInt(i()) != 0 {
+		// The FBlock is pruned, so only the ledger data is saved,
+		// which does not include the Timestamp of the FBlock.
+		col := i()
+		ledger := make([]byte, stmt.ColumnLen(col))
+		stmt.ColumnBytes(col, ledger)
+		tx, _, err := unmarshalLedger(ledger)
+		if err != nil {
+			return tx, err
+		}
+		tx.Timestamp = time.Unix(stmt.ColumnInt64(i()), 0)
+		return tx, nil
+	}
 
 	blob, err := conn.OpenBlob("", "fblock", "data", fblockID, false)
 	if err != nil {
 		return tx, err
 	}
+	defer blob.Close()
 
 	data := make([]byte, size)
-	read, err := blob.ReadAt(data, fbOffset)
-	if err != nil {
-		return tx, err
-	}
-	if read != size {
-		return tx, fmt.Errorf("unexpected end of Transaction data")
+	if compression == CompressionNone {
+		read, err := blob.ReadAt(data, fbOffset)
+		if err != nil {
+			return tx, err
+		}
+		if read != size {
+			return tx, fmt.Errorf("unexpected end of Transaction data")
+		}
+	} else {
+		// Only the FBlock data up to the end of the Transaction is
+		// decompressed.
+		r, err := decompressReader(blob, compression)
+		if err != nil {
+			return tx, err
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, fbOffset); err != nil {
+			return tx, fmt.Errorf("decompress: %w", err)
+		}
+		if _, err := io.ReadFull(r, data); err != nil {
+			return tx, fmt.Errorf("decompress: %w", err)
+		}
 	}
 
 	if err := tx.UnmarshalBinary(data); err != nil {
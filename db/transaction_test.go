@@ -0,0 +1,72 @@
+package db
+
+import (
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxType(t *testing.T) {
+	require := require.New(t)
+
+	tx := fblockChain(t, 1)[0].Transactions[1]
+	require.Equal(TxTypeCoinbase, transactionType(tx, 0))
+	require.Equal(TxTypeNormal, transactionType(tx, 1))
+	tx.TotalFCTOut, tx.TotalECOut = 0, 1
+	require.Equal(TxTypeECPurchase, transactionType(tx, 1))
+}
+
+// rewardChain returns a chain of FBlocks in which the coinbase Transaction
+// of the last FBlock pays a reward.
+func rewardChain(t *testing.T) []factom.FBlock {
+	fbs := fblockChain(t, 3)
+	fb := &fbs[len(fbs)-1]
+	coinbase := fb.Transactions[0]
+	coinbase.FCTOutputs = fb.Transactions[1].FCTOutputs
+	coinbase.TotalFCTOut = fb.Transactions[1].TotalFCTOut
+	fb.Transactions = append([]factom.Transaction{coinbase},
+		fb.Transactions[1:]...)
+	return fbs
+}
+
+// checkTxType checks the type of every Transaction in fbs, and that only the
+// "address_transaction" rows of coinbase Transactions are rewards.
+func checkTxType(require *require.Assertions, conn *sqlite.Conn,
+	fbs []factom.FBlock, msg string) {
+	var outputs int
+	for _, fb := range fbs {
+		var types []TxType
+		require.NoError(sqlitex.Exec(conn, `SELECT "type"
+                        FROM "transaction" WHERE "height" = ?
+                        ORDER BY "id";`,
+			func(stmt *sqlite.Stmt) error {
+				types = append(types, TxType(stmt.ColumnInt64(0)))
+				return nil
+			}, fb.Height))
+		require.Len(types, len(fb.Transactions))
+		require.Equal(TxTypeCoinbase, types[0], msg)
+		for i, tx := range fb.Transactions {
+			require.Equal(transactionType(tx, i), types[i], msg)
+		}
+		outputs += len(fb.Transactions[0].FCTOutputs)
+	}
+	require.NotZero(outputs, "no rewards in test data")
+
+	var rewards int
+	require.NoError(sqlitex.Exec(conn, `SELECT "t"."type", "at"."reward"
+                FROM "address_transaction" AS "at"
+                JOIN "transaction" AS "t" ON "t"."id" = "at"."tx_id";`,
+		func(stmt *sqlite.Stmt) error {
+			reward := stmt.ColumnInt64(1) != 0
+			require.Equal(TxType(stmt.ColumnInt64(0)) == TxTypeCoinbase,
+				reward, msg)
+			if reward {
+				rewards++
+			}
+			return nil
+		}))
+	require.Equal(outputs, rewards, msg)
+}
@@ -0,0 +1,206 @@
+package db
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// CreateTableTxIO is the SQL that creates the "tx_io" table which contains
+// every input and output of each Transaction, in order. Unlike
+// "address_transaction", the amounts are not netted per address, and the
+// table is populated for all Transactions, regardless of any whitelist.
+const CreateTableTxIO = `CREATE TABLE "tx_io" (
+        "tx_id" INT NOT NULL,     -- "transaction"."id"
+        "direction" INT NOT NULL, -- 0: FCT input, 1: FCT output, 2: EC output
+        "index" INT NOT NULL,     -- position within the inputs or outputs
+
+        "address" TEXT NOT NULL,  -- FA or EC address
+        "amount" INT NOT NULL,    -- denoted in factoshis
+
+        PRIMARY KEY("tx_id", "direction", "index"),
+
+        FOREIGN KEY("tx_id") REFERENCES "transaction"("id")
+);
+CREATE INDEX "idx_tx_io_address" ON "tx_io"("address");
+`
+
+// Direction is the "tx_io"."direction" of an input or output.
+type Direction int
+
+const (
+	DirectionInput Direction = iota
+	DirectionOutput
+	DirectionECOutput
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionInput:
+		return "input"
+	case DirectionOutput:
+		return "output"
+	case DirectionECOutput:
+		return "ec_output"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// TxIO is an input or output of a Transaction.
+type TxIO struct {
+	Direction Direction
+	Index     int
+	Address   string
+	Amount    uint64
+}
+
+// InsertTxIO saves the inputs and outputs of tx under txID.
+func InsertTxIO(conn *sqlite.Conn, tx factom.Transaction, txID int64) error {
+	stmt := conn.Prep(`INSERT INTO "tx_io"
+                ("tx_id", "direction", "index", "address", "amount")
+                VALUES (?, ?, ?, ?, ?);`)
+	defer stmt.Reset()
+	stmt.BindInt64(sqlite.BindIndexStart, txID)
+
+	for _, txIO := range txIOs(tx) {
+		i := sqlite.NewIncrementor(sqlite.BindIndexStart + 1)
+		stmt.BindInt64(i(), int64(txIO.Direction))
+		stmt.BindInt64(i(), int64(txIO.Index))
+		stmt.BindText(i(), txIO.Address)
+		stmt.BindInt64(i(), int64(txIO.Amount))
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		if err := stmt.Reset(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// txIOs returns the inputs and outputs of tx, in order.
+func txIOs(tx factom.Transaction) []TxIO {
+	var ios []TxIO
+	for i, adr := range tx.FCTInputs {
+		ios = append(ios, TxIO{DirectionInput, i,
+			adr.FAAddress().String(), adr.Amount})
+	}
+	for i, adr := range tx.FCTOutputs {
+		ios = append(ios, TxIO{DirectionOutput, i,
+			adr.FAAddress().String(), adr.Amount})
+	}
+	for i, adr := range tx.ECOutputs {
+		ios = append(ios, TxIO{DirectionECOutput, i,
+			adr.ECAddress().String(), adr.Amount})
+	}
+	return ios
+}
+
+// SelectTxIO returns the inputs and outputs of the Transaction with rowID,
+// in order.
+func SelectTxIO(conn *sqlite.Conn, rowID int64) ([]TxIO, error) {
+	stmt := conn.Prep(`SELECT "direction", "index", "address", "amount"
+                FROM "tx_io" WHERE "tx_id" = ?
+                ORDER BY "direction", "index";`)
+	defer stmt.Reset()
+	stmt.BindInt64(sqlite.BindIndexStart, rowID)
+
+	var ios []TxIO
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			return ios, nil
+		}
+		i := sqlite.ColumnIncrementor()
+		ios = append(ios, TxIO{
+			Direction: Direction(stmt.ColumnInt64(i())),
+			Index:     int(stmt.ColumnInt64(i())),
+			Address:   stmt.ColumnText(i()),
+			Amount:    uint64(stmt.ColumnInt64(i())),
+		})
+	}
+}
+
+// populateTxIO populates "tx_io" for every saved Transaction from the FBlock
+// data, or the ledger data of a pruned FBlock. The signatures are not
+// verified again.
+func populateTxIO(conn *sqlite.Conn) error {
+	fbs := conn.Prep(`SELECT "height", "data", "compression" FROM "fblock"
+                WHERE NOT "pruned";`)
+	defer fbs.Reset()
+	txs := conn.Prep(`SELECT "id", "fb_offset", "size" FROM "transaction"
+                WHERE "height" = ?;`)
+	defer txs.Reset()
+	for {
+		hasRow, err := fbs.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			break
+		}
+		height := fbs.ColumnInt64(0)
+		data := make([]byte, fbs.ColumnLen(1))
+		fbs.ColumnBytes(1, data)
+		data, err = decompress(data, Compression(fbs.ColumnInt64(2)))
+		if err != nil {
+			return fmt.Errorf("FBlock %v: %w", height, err)
+		}
+
+		txs.BindInt64(sqlite.BindIndexStart, height)
+		for {
+			hasRow, err := txs.Step()
+			if err != nil {
+				return err
+			}
+			if !hasRow {
+				break
+			}
+			offset, size := txs.ColumnInt64(1), txs.ColumnInt64(2)
+			if offset+size > int64(len(data)) {
+				return fmt.Errorf(
+					"FBlock %v: unexpected end of Transaction data",
+					height)
+			}
+			if err := populateTxIOFromLedger(conn, txs.ColumnInt64(0),
+				data[offset:offset+size]); err != nil {
+				return fmt.Errorf("FBlock %v: %w", height, err)
+			}
+		}
+		if err := txs.Reset(); err != nil {
+			return err
+		}
+	}
+
+	pruned := conn.Prep(`SELECT "t"."id", "ledger" FROM "transaction" AS "t"
+                JOIN "fblock" AS "f" ON "t"."height" = "f"."height"
+                WHERE "pruned";`)
+	defer pruned.Reset()
+	for {
+		hasRow, err := pruned.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			return nil
+		}
+		ledger := make([]byte, pruned.ColumnLen(1))
+		pruned.ColumnBytes(1, ledger)
+		if err := populateTxIOFromLedger(conn, pruned.ColumnInt64(0),
+			ledger); err != nil {
+			return err
+		}
+	}
+}
+
+func populateTxIOFromLedger(conn *sqlite.Conn, txID int64, data []byte) error {
+	tx, _, err := unmarshalLedger(data)
+	if err != nil {
+		return err
+	}
+	return InsertTxIO(conn, tx, txID)
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/stretchr/testify/require"
+)
+
+// checkTxIO checks the "tx_io" rows of every Transaction in fbs.
+func checkTxIO(require *require.Assertions, conn *sqlite.Conn,
+	fbs []factom.FBlock, msg string) {
+	for _, fb := range fbs {
+		var txIDs []int64
+		require.NoError(sqlitex.Exec(conn, `SELECT "id"
+                        FROM "transaction" WHERE "height" = ?
+                        ORDER BY "id";`,
+			func(stmt *sqlite.Stmt) error {
+				txIDs = append(txIDs, stmt.ColumnInt64(0))
+				return nil
+			}, fb.Height))
+		require.Len(txIDs, len(fb.Transactions))
+		for i, tx := range fb.Transactions {
+			ios, err := SelectTxIO(conn, txIDs[i])
+			require.NoError(err, "SelectTxIO()")
+			require.Equal(txIOs(tx), ios, msg)
+		}
+	}
+}
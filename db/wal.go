@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// enableWAL sets the journal_mode to WAL, so that readers do not block the
+// writer, and readers always see the latest committed FBlocks.
+//
+// In WAL mode synchronous=NORMAL cannot corrupt the database, but the latest
+// commits may be rolled back after a power loss, and will be scanned again.
+func enableWAL(conn *sqlite.Conn) error {
+	var mode string
+	if err := sqlitex.ExecTransient(conn, `PRAGMA journal_mode = WAL;`,
+		func(stmt *sqlite.Stmt) error {
+			mode = stmt.ColumnText(0)
+			return nil
+		}); err != nil {
+		return err
+	}
+	switch mode {
+	case "wal":
+	case "memory": // An in-memory database has no WAL.
+		return nil
+	default:
+		return fmt.Errorf("unable to enable WAL journal_mode: %v", mode)
+	}
+	return sqlitex.ExecTransient(conn, `PRAGMA synchronous = NORMAL;`, nil)
+}
+
+// OpenReadPool opens a pool of size read-only connections to the database at
+// uri, which must already be set up. Readers see a consistent snapshot for
+// the duration of each transaction, and never block the writer.
+func OpenReadPool(uri string, size int) (*sqlitex.Pool, error) {
+	return sqlitex.Open(uri, sqlite.SQLITE_OPEN_READONLY|
+		sqlite.SQLITE_OPEN_URI|sqlite.SQLITE_OPEN_NOMUTEX, size)
+}
+
+// SetAutoCheckpoint sets the number of WAL pages after which conn
+// automatically checkpoints on commit. A value of 0 disables automatic
+// checkpoints, so they must be run with Checkpoint.
+func SetAutoCheckpoint(conn *sqlite.Conn, pages int) error {
+	return sqlitex.ExecTransient(conn,
+		fmt.Sprintf(`PRAGMA wal_autocheckpoint = %d;`, pages), nil)
+}
+
+// CheckpointMode is the mode of a WAL checkpoint.
+type CheckpointMode string
+
+const (
+	// CheckpointPassive copies as many frames as possible to the
+	// database without waiting for any readers.
+	CheckpointPassive CheckpointMode = "PASSIVE"
+
+	// CheckpointTruncate waits for readers, checkpoints all frames, and
+	// then truncates the WAL file to zero bytes.
+	CheckpointTruncate CheckpointMode = "TRUNCATE"
+)
+
+// WALCheckpoint is the result of a Checkpoint.
+type WALCheckpoint struct {
+	// Busy is true if the checkpoint could not complete because of
+	// readers or writers.
+	Busy bool
+
+	// Log is the number of pages in the WAL, and Checkpointed is the
+	// number of those copied to the database.
+	Log, Checkpointed int
+}
+
+// DurableCheckpoint checkpoints all frames of the WAL into the database and
+// syncs it to disk, even if conn is configured not to sync, so that the
+// database file is consistent on disk. It waits for readers, and if they
+// prevent the checkpoint from completing, Busy is set.
+func DurableCheckpoint(conn *sqlite.Conn) (ckpt WALCheckpoint, err error) {
+	var synchronous int
+	if err := sqlitex.ExecTransient(conn, `PRAGMA synchronous;`,
+		func(stmt *sqlite.Stmt) error {
+			synchronous = stmt.ColumnInt(0)
+			return nil
+		}); err != nil {
+		return ckpt, err
+	}
+	if err := sqlitex.ExecTransient(conn,
+		`PRAGMA synchronous = FULL;`, nil); err != nil {
+		return ckpt, err
+	}
+	defer func() {
+		restore := sqlitex.ExecTransient(conn, fmt.Sprintf(
+			`PRAGMA synchronous = %d;`, synchronous), nil)
+		if err == nil {
+			err = restore
+		}
+	}()
+	return Checkpoint(conn, CheckpointTruncate)
+}
+
+// Checkpoint runs a WAL checkpoint of the given mode. For a database which is
+// not in WAL mode, Log and Checkpointed are -1.
+func Checkpoint(conn *sqlite.Conn, mode CheckpointMode) (WALCheckpoint, error) {
+	var ckpt WALCheckpoint
+	err := sqlitex.ExecTransient(conn,
+		fmt.Sprintf(`PRAGMA wal_checkpoint(%v);`, mode),
+		func(stmt *sqlite.Stmt) error {
+			ckpt.Busy = stmt.ColumnInt(0) != 0
+			ckpt.Log = stmt.ColumnInt(1)
+			ckpt.Checkpointed = stmt.ColumnInt(2)
+			return nil
+		})
+	return ckpt, err
+}
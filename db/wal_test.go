@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.sqlite3")
+	conn, err := sqlite.OpenConn(path, 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+	require.NoError(SetAutoCheckpoint(conn, 0))
+
+	readers, err := OpenReadPool(path, 2)
+	require.NoError(err, "OpenReadPool()")
+	defer readers.Close()
+
+	var fb factom.FBlock
+	require.NoError(fb.UnmarshalBinary(fblockData))
+	fb.PrevKeyMR = new(factom.Bytes32)
+
+	// A reader is not blocked by an open write transaction, and sees
+	// only committed data.
+	release := sqlitex.Save(conn)
+	require.NoError(InsertFBlock(conn, fb, 0, CompressionNone, nil), "InsertFBlock()")
+	reader := readers.Get(context.Background())
+	_, err = SelectFBlockKeyMR(reader, fb.Height)
+	require.Equal(ErrNoFBlock, err, "uncommitted")
+	readers.Put(reader)
+	var commit error
+	release(&commit)
+	require.NoError(commit)
+
+	reader = readers.Get(context.Background())
+	keyMR, err := SelectFBlockKeyMR(reader, fb.Height)
+	require.NoError(err, "committed")
+	require.Equal(*fb.KeyMR, keyMR)
+	readers.Put(reader)
+
+	ckpt, err := Checkpoint(conn, CheckpointPassive)
+	require.NoError(err, "Checkpoint()")
+	require.False(ckpt.Busy)
+	require.Greater(ckpt.Log, 0)
+	require.Equal(ckpt.Log, ckpt.Checkpointed)
+
+	ckpt, err = Checkpoint(conn, CheckpointTruncate)
+	require.NoError(err, "Checkpoint()")
+	require.Equal(WALCheckpoint{}, ckpt, "truncated")
+}
+
+func TestSpeed(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.sqlite3")
+	conn, err := sqlite.OpenConn(path, 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(Setup(conn, true, log.Logger{}), "Setup()")
+
+	var fb factom.FBlock
+	require.NoError(fb.UnmarshalBinary(fblockData))
+	fb.PrevKeyMR = new(factom.Bytes32)
+	require.NoError(InsertFBlock(conn, fb, 0, CompressionNone, nil), "InsertFBlock()")
+
+	ckpt, err := DurableCheckpoint(conn)
+	require.NoError(err, "DurableCheckpoint()")
+	require.Equal(WALCheckpoint{}, ckpt, "truncated")
+	synchronous, err := sqlitex.ResultInt(conn.Prep(`PRAGMA synchronous;`))
+	require.NoError(err)
+	require.Equal(0, synchronous, "restored OFF")
+
+	bulk, err := bulkLoadInProgress(conn)
+	require.NoError(err)
+	require.True(bulk, "bulk load in progress")
+	version, err := getDBVersion(conn)
+	require.NoError(err)
+	require.Equal(currentDBVersion, version)
+
+	require.NoError(EndSpeed(conn), "EndSpeed()")
+	synchronous, err = sqlitex.ResultInt(conn.Prep(`PRAGMA synchronous;`))
+	require.NoError(err)
+	require.Equal(1, synchronous, "NORMAL")
+	bulk, err = bulkLoadInProgress(conn)
+	require.NoError(err)
+	require.False(bulk, "bulk load complete")
+
+	// Violate a foreign key, as is possible during speed mode.
+	require.NoError(optimizeSpeed(conn))
+	require.NoError(sqlitex.ExecTransient(conn, `INSERT INTO "transaction"
+                ("height", "fb_offset", "size", "timestamp", "total_fct_in",
+                "total_fct_out", "total_ec_out", "hash")
+                VALUES (1, 0, 0, 0, 0, 0, 0, x'00');`, nil))
+	require.NoError(setBulkLoad(conn, true))
+	require.Error(EndSpeed(conn), "foreign key violation")
+
+	// The interrupted bulk load is checked on startup, even without
+	// speed mode.
+	require.Error(Setup(conn, false, log.Logger{}), "foreign key violation")
+	require.NoError(sqlitex.ExecTransient(conn,
+		`DELETE FROM "transaction" WHERE "height" = 1;`, nil))
+	require.NoError(Setup(conn, false, log.Logger{}), "Setup()")
+	bulk, err = bulkLoadInProgress(conn)
+	require.NoError(err)
+	require.False(bulk, "checked")
+}
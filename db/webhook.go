@@ -0,0 +1,171 @@
+package db
+
+import (
+	"time"
+
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// CreateTableWebhookDelivery is the SQL that creates the "webhook_delivery"
+// table which queues notifications of address activity for delivery to
+// webhook URLs. A row is never removed after delivery so that the same
+// tx/address pair is never enqueued twice for the same URL.
+const CreateTableWebhookDelivery = `CREATE TABLE "webhook_delivery" (
+        "id" INTEGER PRIMARY KEY,
+
+        "url" TEXT NOT NULL,
+        "tx_id" INT NOT NULL,  -- "transaction"."id"
+        "adr_id" INT NOT NULL, -- "address"."id"
+
+        "attempts" INT NOT NULL DEFAULT 0,
+        "next_attempt" INT NOT NULL DEFAULT 0, -- unix timestamp
+        "delivered" INT, -- unix timestamp, NULL until delivered
+
+        UNIQUE("url", "tx_id", "adr_id"),
+
+        FOREIGN KEY("tx_id") REFERENCES "transaction"("id"),
+        FOREIGN KEY("adr_id") REFERENCES "address"("id")
+);
+CREATE INDEX "idx_webhook_delivery_pending" ON "webhook_delivery"
+        ("next_attempt") WHERE "delivered" IS NULL;
+`
+
+// EnqueueWebhooks adds a pending delivery to each of urls for every
+// "address_transaction" row in the FBlock at height that involves an address
+// in whitelist, or any address if whitelist is nil. Rows that were already
+// enqueued are ignored.
+func EnqueueWebhooks(conn *sqlite.Conn, height uint32, urls []string,
+	whitelist map[factom.FAAddress]struct{}) error {
+	if len(urls) == 0 {
+		return nil
+	}
+
+	sel := conn.Prep(`SELECT "at"."tx_id", "at"."adr_id", "a"."adr"
+                FROM "address_transaction" AS "at"
+                JOIN "transaction" AS "t" ON "t"."id" = "at"."tx_id"
+                JOIN "address" AS "a" ON "a"."id" = "at"."adr_id"
+                WHERE "t"."height" = ?;`)
+	defer sel.Reset()
+	sel.BindInt64(sqlite.BindIndexStart, int64(height))
+
+	ins := conn.Prep(`INSERT OR IGNORE INTO "webhook_delivery"
+                ("url", "tx_id", "adr_id") VALUES (?, ?, ?);`)
+	defer ins.Reset()
+
+	for {
+		hasRow, err := sel.Step()
+		if err != nil {
+			return err
+		}
+		if !hasRow {
+			return nil
+		}
+		i := sqlite.ColumnIncrementor()
+		txID := sel.ColumnInt64(i())
+		adrID := sel.ColumnInt64(i())
+		if whitelist != nil {
+			var adr factom.FAAddress
+			if err := adr.Set(sel.ColumnText(i())); err != nil {
+				return err
+			}
+			if _, ok := whitelist[adr]; !ok {
+				continue
+			}
+		}
+		for _, url := range urls {
+			i := sqlite.BindIncrementor()
+			ins.BindText(i(), url)
+			ins.BindInt64(i(), txID)
+			ins.BindInt64(i(), adrID)
+			if _, err := ins.Step(); err != nil {
+				return err
+			}
+			ins.Reset()
+		}
+	}
+}
+
+// WebhookDelivery is a pending notification of an address's activity in a
+// transaction.
+type WebhookDelivery struct {
+	ID       int64
+	URL      string
+	Attempts int64
+
+	TxID      factom.Bytes32
+	Height    uint32
+	Timestamp time.Time
+	Address   string
+	Amount    int64
+}
+
+// SelectPendingWebhooks returns up to limit undelivered WebhookDeliveries
+// whose next attempt is due at or before now.
+func SelectPendingWebhooks(conn *sqlite.Conn, now time.Time,
+	limit int) ([]WebhookDelivery, error) {
+	stmt := conn.Prep(`SELECT "w"."id", "w"."url", "w"."attempts",
+                        "t"."hash", "t"."height", "t"."timestamp",
+                        "a"."adr", "at"."amount"
+                FROM "webhook_delivery" AS "w"
+                JOIN "transaction" AS "t" ON "t"."id" = "w"."tx_id"
+                JOIN "address" AS "a" ON "a"."id" = "w"."adr_id"
+                JOIN "address_transaction" AS "at"
+                        ON "at"."tx_id" = "w"."tx_id"
+                        AND "at"."adr_id" = "w"."adr_id"
+                WHERE "w"."delivered" IS NULL AND "w"."next_attempt" <= ?
+                ORDER BY "w"."id" LIMIT ?;`)
+	defer stmt.Reset()
+	i := sqlite.BindIncrementor()
+	stmt.BindInt64(i(), now.Unix())
+	stmt.BindInt64(i(), int64(limit))
+
+	var deliveries []WebhookDelivery
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			return deliveries, nil
+		}
+		var d WebhookDelivery
+		i := sqlite.ColumnIncrementor()
+		d.ID = stmt.ColumnInt64(i())
+		d.URL = stmt.ColumnText(i())
+		d.Attempts = stmt.ColumnInt64(i())
+		stmt.ColumnBytes(i(), d.TxID[:])
+		d.Height = uint32(stmt.ColumnInt64(i()))
+		d.Timestamp = time.Unix(stmt.ColumnInt64(i()), 0)
+		d.Address = stmt.ColumnText(i())
+		d.Amount = stmt.ColumnInt64(i())
+		deliveries = append(deliveries, d)
+	}
+}
+
+// MarkWebhookDelivered records that the delivery with id succeeded at now.
+func MarkWebhookDelivered(conn *sqlite.Conn, id int64, now time.Time) error {
+	stmt := conn.Prep(`UPDATE "webhook_delivery" SET
+                "attempts" = "attempts" + 1, "delivered" = ?
+                WHERE "id" = ?;`)
+	defer stmt.Reset()
+	i := sqlite.BindIncrementor()
+	stmt.BindInt64(i(), now.Unix())
+	stmt.BindInt64(i(), id)
+	_, err := stmt.Step()
+	return err
+}
+
+// MarkWebhookFailed records a failed attempt of the delivery with id and
+// schedules the next attempt.
+func MarkWebhookFailed(conn *sqlite.Conn, id int64, next time.Time) error {
+	stmt := conn.Prep(`UPDATE "webhook_delivery" SET
+                "attempts" = "attempts" + 1, "next_attempt" = ?
+                WHERE "id" = ?;`)
+	defer stmt.Reset()
+	i := sqlite.BindIncrementor()
+	stmt.BindInt64(i(), next.Unix())
+	stmt.BindInt64(i(), id)
+	_, err := stmt.Step()
+	return err
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/canonical-ledgers/fblock-scan/db"
+)
+
+// backups writes a backup, or a snapshot if cfg.BackupSnapshot is set, to
+// cfg.BackupPath every cfg.BackupInterval until ctx is done. Failed backups
+// are logged and retried at the next interval.
+func (cfg Config) backups(ctx context.Context) error {
+	ticker := time.NewTicker(cfg.BackupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		if err := cfg.backup(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			cfg.Log.Error("backup failed", "path", cfg.BackupPath,
+				"err", err)
+		}
+	}
+}
+
+func (cfg Config) backup(ctx context.Context) error {
+	conn := cfg.readers.Get(ctx)
+	if conn == nil {
+		return ctx.Err()
+	}
+	defer cfg.readers.Put(conn)
+
+	start := time.Now()
+	if cfg.BackupSnapshot {
+		m, err := db.WriteSnapshot(conn, cfg.BackupPath)
+		if err != nil {
+			return err
+		}
+		cfg.Log.Info("snapshot written", "path", cfg.BackupPath,
+			"sync_height", m.SyncHeight, "duration", time.Since(start))
+		return nil
+	}
+	if err := db.Backup(conn, cfg.BackupPath); err != nil {
+		return err
+	}
+	cfg.Log.Info("backup written", "path", cfg.BackupPath,
+		"duration", time.Since(start))
+	return nil
+}
@@ -3,34 +3,180 @@ package engine
 import (
 	"context"
 	"fmt"
+	"strings"
+	"time"
 
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/AdamSLevy/retry"
 	"github.com/Factom-Asset-Tokens/factom"
 	"github.com/canonical-ledgers/cryptoprice/v2"
-	"github.com/cheggaaa/pb/v3"
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"github.com/canonical-ledgers/fblock-scan/log"
 )
 
 type Config struct {
-	C               *factom.Client
+	// Factomd are the factomd API endpoints. Requests are spread across
+	// them round-robin, skipping any which have recently failed.
+	Factomd []string
+
+	// CrossValidate fetches the KeyMR of each FBlock from two different
+	// Factomd endpoints and refuses to insert it if they disagree.
+	CrossValidate bool
+
 	DBURI           string
 	Whitelist       map[factom.FAAddress]struct{}
 	Price           *cryptoprice.Client
 	StartScanHeight uint32
-	Debug           bool
-	Speed           bool
 
-	syncBar *pb.ProgressBar
+	// AutoStart discovers the start height of a new database as the
+	// first FBlock, at or after StartScanHeight, with a Transaction
+	// involving a Whitelist address.
+	AutoStart bool
+
+	// Backfill scans any unscanned heights from StartScanHeight up to the
+	// latest saved FBlock of an existing database before resuming the
+	// scan.
+	Backfill bool
+
+	// Snapshot is the path of a snapshot written by db.WriteSnapshot which
+	// a new database is restored from, after it is verified, so that the
+	// scan resumes from its sync height. It is ignored for an existing
+	// database.
+	Snapshot string
+
+	// ScanRange scans only the unscanned heights from StartScanHeight up
+	// to StopHeight, or the chain tip if StopHeight is nil, of a new or
+	// existing database. Heights below StartScanHeight are not
+	// backfilled, and if StartScanHeight is above the latest saved
+	// FBlock, the heights in between are left unscanned.
+	ScanRange bool
+
+	// StopHeight, if not nil, is the last height to scan before stopping.
+	StopHeight *uint32
+
+	// Once stops the engine after syncing to the current chain tip.
+	Once  bool
+	Debug bool
+
+	// Speed disables syncing to disk and foreign key checks until the
+	// initial sync reaches the chain tip of a synced factomd, or the scan
+	// completes, when a foreign key check is run. The
+	// database is made durable every 10,000 heights, and is checked
+	// for corruption on startup, and also for foreign key violations if
+	// a previous initial sync in speed mode did not complete.
+	Speed bool
+
+	// Compression is used for the data of each new FBlock. Existing
+	// FBlocks are not recompressed, see db.CompressFBlocks.
+	Compression db.Compression
+
+	// Prune replaces the data of all but the latest PruneKeep FBlocks
+	// with their headers, keeping only the ledger data of their
+	// Transactions. Pruned FBlocks are fetched from factomd when their
+	// data is needed. See db.PruneFBlocks.
+	Prune     bool
+	PruneKeep uint32
+
+	// Log receives all engine and database log messages.
+	Log log.Logger
+
+	// OnProgress, if not nil, is called with the SyncStatus whenever it
+	// changes. It must not block.
+	OnProgress func(SyncStatus)
+
+	// RefreshInterval is how often the chain height is refreshed during a
+	// sync.
+	RefreshInterval time.Duration
+
+	// PollInterval is how often factomd is checked for a new block once
+	// synced.
+	PollInterval time.Duration
+
+	// AdaptivePolling predicts the arrival of the next block from the
+	// timestamps of recent blocks, and waits until then before polling
+	// every PollInterval.
+	AdaptivePolling bool
+
+	// Retry is the policy for retrying failed factomd and price API
+	// requests.
+	Retry retry.Policy
+
+	// RequirePrice causes the engine to stop if the price of an FBlock
+	// cannot be determined once Retry is exhausted. Otherwise the FBlock
+	// is saved with a NULL price.
+	RequirePrice bool
+
+	// Trigger causes an immediate check for a new block when received
+	// from once synced. It may be nil.
+	Trigger <-chan struct{}
+
+	// Webhooks are URLs which are POSTed a WebhookEvent for each
+	// transaction involving a tracked address, at least once.
+	Webhooks []string
+
+	// WebhooksFrom, if not 0, is the lowest height for which webhooks are
+	// enqueued. Otherwise, the historical FBlocks of the initial sync and
+	// any backfill are not notified. Webhooks are enqueued once the chain
+	// tip is reached by a new database, or for every FBlock above the
+	// latest saved height of an existing database.
+	WebhooksFrom uint32
+
+	// ReadPoolSize is the number of read-only database connections
+	// available to the HTTP server and to Engine.Readers.
+	ReadPoolSize int
+
+	// BackupPath, if BackupInterval is not 0, is where a consistent copy
+	// of the database, or a snapshot if BackupSnapshot is set, is written
+	// every BackupInterval while the engine runs. Each backup replaces
+	// the previous one.
+	BackupPath     string
+	BackupInterval time.Duration
+	BackupSnapshot bool
+
+	// ShutdownTimeout is how long to keep saving FBlocks that have
+	// already been fetched once the engine is stopped.
+	ShutdownTimeout time.Duration
+
+	// ListenAddr is the address for the HTTP server exposing "/metrics",
+	// "/healthz", "/readyz", "/status" and "/stream". If empty, no server is
+	// started.
+	ListenAddr string
+
+	endpoints *endpoints
+	progress  *progress
+	pause     *pauser
+	readers   *sqlitex.Pool
+	metrics   *metrics
+	health    *health
+	stream    *broadcaster
 }
 
 func NewConfig() Config {
 	return Config{
-		C:     factom.NewClient(),
-		Price: cryptoprice.NewClient("FCT", "USD"),
+		Factomd: []string{factom.FactomdDefault},
+		Price:   cryptoprice.NewClient("FCT", "USD"),
+
+		RefreshInterval: 5 * time.Minute,
+		PollInterval:    15 * time.Second,
+		AdaptivePolling: true,
+
+		Retry: NewRetryPolicy(200, 30*time.Minute),
+
+		ReadPoolSize:    4,
+		ShutdownTimeout: 30 * time.Second,
+
+		metrics: newMetrics(),
+		health:  new(health),
+		stream:  newBroadcaster(),
 	}
 }
 
 func (cfg Config) String() string {
-	s := fmt.Sprintln("factomd:", cfg.C.FactomdServer)
+	s := fmt.Sprintln("factomd:", strings.Join(cfg.Factomd, ", "))
 	s += fmt.Sprintln("DB URI:", cfg.DBURI)
+	if cfg.ListenAddr != "" {
+		s += fmt.Sprintln("Listening on:", cfg.ListenAddr)
+	}
 	if cfg.Whitelist == nil {
 		s += fmt.Sprintln("Tracking All Addresses")
 	} else {
@@ -45,13 +191,15 @@ func (cfg Config) String() string {
 
 func (cfg Config) checkNetworkID(ctx context.Context) error {
 	var db factom.DBlock
-	if err := db.Get(ctx, cfg.C); err != nil {
+	if err := cfg.factomd(ctx, "dblock", func(c *factom.Client) error {
+		return db.Get(ctx, c)
+	}); err != nil {
 		return fmt.Errorf("factom.DBlock.Get(): %w", err)
 	}
 
 	if !db.NetworkID.IsMainnet() {
-		return fmt.Errorf("connected to Factom %v but expected %v",
-			db.NetworkID, factom.MainnetID())
+		return PermanentError{fmt.Errorf("connected to Factom %v but expected %v",
+			db.NetworkID, factom.MainnetID())}
 	}
 	return nil
 }
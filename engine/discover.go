@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"golang.org/x/sync/errgroup"
+)
+
+// discoverWorkers is the number of concurrent FBlock requests made while
+// discovering the start height.
+const discoverWorkers = 8
+
+// discoverStartHeight returns the lowest height from from to to, inclusive,
+// of an FBlock with a Transaction involving a whitelisted address. If there
+// is none, to+1 is returned.
+//
+// FBlocks are fetched by height, concurrently, and are only inspected, not
+// saved, which is far cheaper than a full scan. They are not verified, but
+// the FBlocks saved by the subsequent scan are.
+func (cfg Config) discoverStartHeight(ctx context.Context,
+	from, to uint32) (uint32, error) {
+	cfg.Log.Info("discovering start height for whitelisted addresses",
+		"from", from, "to", to)
+	logged := from
+	height, found, err := findFirst(ctx, from, to, discoverWorkers,
+		func(height uint32) (bool, error) {
+			fb := factom.FBlock{Height: height}
+			if err := cfg.factomd(ctx, "fblock",
+				func(c *factom.Client) error {
+					return fb.Get(ctx, c)
+				}); err != nil {
+				return false, fmt.Errorf(
+					"factom.FBlock.Get(): %w", err)
+			}
+			return cfg.involvesWhitelist(fb), nil
+		},
+		func(height uint32) {
+			if height >= logged+10000 {
+				logged = height
+				cfg.Log.Info("discovering start height",
+					"height", height)
+			}
+		})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		cfg.Log.Info("no transactions found for whitelisted addresses, "+
+			"starting after the chain tip", "height", to+1)
+		return to + 1, nil
+	}
+	cfg.Log.Info("discovered start height", "height", height)
+	return height, nil
+}
+
+// involvesWhitelist returns true if any Transaction in fb has an input or
+// output to a whitelisted address.
+func (cfg Config) involvesWhitelist(fb factom.FBlock) bool {
+	for _, tx := range fb.Transactions {
+		for _, adrs := range [][]factom.AddressAmount{
+			tx.FCTInputs, tx.FCTOutputs} {
+			for _, adr := range adrs {
+				if _, ok := cfg.Whitelist[adr.FAAddress()]; ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// findFirst returns the lowest height from from to to, inclusive, for which
+// match returns true. Heights are checked in windows of workers heights at a
+// time, concurrently within each window, and the search stops after the
+// first window with a match. After each window without a match, progress is
+// called with the last height checked.
+func findFirst(ctx context.Context, from, to uint32, workers int,
+	match func(uint32) (bool, error),
+	progress func(uint32)) (uint32, bool, error) {
+	for start := int64(from); start <= int64(to); start += int64(workers) {
+		if err := ctx.Err(); err != nil {
+			return 0, false, err
+		}
+		end := start + int64(workers) - 1
+		if end > int64(to) {
+			end = int64(to)
+		}
+		matches := make([]bool, end-start+1)
+		var g errgroup.Group
+		for height := start; height <= end; height++ {
+			height, start := height, start
+			g.Go(func() (err error) {
+				matches[height-start], err = match(uint32(height))
+				return
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return 0, false, err
+		}
+		for i, ok := range matches {
+			if ok {
+				return uint32(start) + uint32(i), true, nil
+			}
+		}
+		progress(uint32(end))
+	}
+	return 0, false, nil
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindFirst(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	nop := func(uint32) {}
+
+	// All heights in a window are checked concurrently, but the lowest
+	// match is returned.
+	above := func(first uint32) func(uint32) (bool, error) {
+		return func(height uint32) (bool, error) {
+			return height >= first, nil
+		}
+	}
+	height, found, err := findFirst(ctx, 10, 100, 8, above(25), nop)
+	require.NoError(err)
+	require.True(found)
+	require.EqualValues(25, height)
+
+	height, found, err = findFirst(ctx, 10, 100, 8, above(10), nop)
+	require.NoError(err)
+	require.True(found)
+	require.EqualValues(10, height, "first height")
+
+	height, found, err = findFirst(ctx, 10, 100, 8, above(100), nop)
+	require.NoError(err)
+	require.True(found)
+	require.EqualValues(100, height, "last height")
+
+	var last uint32
+	_, found, err = findFirst(ctx, 10, 100, 8, above(101),
+		func(height uint32) { last = height })
+	require.NoError(err)
+	require.False(found)
+	require.EqualValues(100, last, "progress")
+
+	_, _, err = findFirst(ctx, 10, 100, 8, func(height uint32) (bool, error) {
+		if height == 50 {
+			return false, fmt.Errorf("failed")
+		}
+		return false, nil
+	}, nop)
+	require.EqualError(err, "failed")
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// maxEndpointBackoff is the longest an endpoint is avoided after repeated
+// failures.
+const maxEndpointBackoff = 5 * time.Minute
+
+// endpoints is a set of factomd Clients which are used round-robin, skipping
+// any that have recently failed.
+type endpoints struct {
+	sync.Mutex
+	clients []*endpoint
+	next    int
+}
+
+type endpoint struct {
+	*factom.Client
+
+	// failures is the number of consecutive failed requests.
+	failures uint
+
+	// downUntil is when the endpoint may be used again after a failure.
+	downUntil time.Time
+}
+
+func newEndpoints(urls []string) *endpoints {
+	e := endpoints{clients: make([]*endpoint, len(urls))}
+	for i, url := range urls {
+		c := factom.NewClient()
+		c.FactomdServer = url
+		e.clients[i] = &endpoint{Client: c}
+	}
+	return &e
+}
+
+// pick returns the next healthy endpoint in round-robin order, excluding
+// except. If all are down, the endpoint which will recover soonest is
+// returned. If except is the only endpoint, nil is returned.
+func (e *endpoints) pick(except *factom.Client) *endpoint {
+	e.Lock()
+	defer e.Unlock()
+	now := time.Now()
+	var soonest *endpoint
+	for i := range e.clients {
+		ep := e.clients[(e.next+i)%len(e.clients)]
+		if ep.Client == except {
+			continue
+		}
+		if !now.Before(ep.downUntil) {
+			e.next = (e.next + i + 1) % len(e.clients)
+			return ep
+		}
+		if soonest == nil || ep.downUntil.Before(soonest.downUntil) {
+			soonest = ep
+		}
+	}
+	return soonest
+}
+
+// report records whether ep was healthy during a request. It returns true if
+// ep changed from healthy to down, or vice versa.
+func (e *endpoints) report(ep *endpoint, healthy bool) (changed bool) {
+	e.Lock()
+	defer e.Unlock()
+	if healthy {
+		changed = ep.failures > 0
+		ep.failures = 0
+		ep.downUntil = time.Time{}
+		return
+	}
+	changed = ep.failures == 0
+	ep.failures++
+	backoff := maxEndpointBackoff
+	if ep.failures < 9 {
+		backoff = time.Second << ep.failures
+	}
+	ep.downUntil = time.Now().Add(backoff)
+	return
+}
+
+// len returns the number of endpoints.
+func (e *endpoints) len() int {
+	return len(e.clients)
+}
@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpoints(t *testing.T) {
+	require := require.New(t)
+
+	e := newEndpoints([]string{"a", "b", "c"})
+	var order []string
+	for i := 0; i < 4; i++ {
+		order = append(order, e.pick(nil).FactomdServer)
+	}
+	require.Equal([]string{"a", "b", "c", "a"}, order, "round-robin")
+
+	b := e.clients[1]
+	require.True(e.report(b, false), "b down")
+	require.False(e.report(b, false), "b still down")
+	for i := 0; i < 4; i++ {
+		require.NotEqual("b", e.pick(nil).FactomdServer, "skip b")
+	}
+	require.Equal("c", e.pick(e.clients[0].Client).FactomdServer, "except a")
+
+	// All down, so the endpoint which recovers soonest is used.
+	e.report(e.clients[0], false)
+	e.report(e.clients[2], false)
+	require.NotEqual("b", e.pick(nil).FactomdServer)
+
+	require.True(e.report(b, true), "b recovered")
+
+	single := newEndpoints([]string{"a"})
+	require.Nil(single.pick(single.clients[0].Client))
+}
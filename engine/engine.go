@@ -0,0 +1,374 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"golang.org/x/sync/errgroup"
+)
+
+// Engine scans FBlocks from factomd into a database according to its
+// Config.
+//
+// An Engine is started once with Start, and runs until it is stopped with
+// Stop, its context is done, or if Config.Once or Config.StopHeight is set,
+// until the scan is complete. Wait returns the terminal error.
+type Engine struct {
+	cfg Config
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// New returns an Engine for cfg, which should be created with NewConfig.
+func New(cfg Config) *Engine {
+	cfg.progress = &progress{onUpdate: cfg.OnProgress}
+	cfg.pause = newPauser()
+	return &Engine{cfg: cfg}
+}
+
+// Start validates the Config, connects to factomd and sets up the database,
+// returning any error, and then runs the engine in the background until ctx
+// is done or Stop is called.
+func (e *Engine) Start(ctx context.Context) (err error) {
+	if e.done != nil {
+		return fmt.Errorf("engine already started")
+	}
+	cfg := &e.cfg
+	if len(cfg.Factomd) == 0 {
+		return fmt.Errorf("no factomd endpoints")
+	}
+	if cfg.BackupInterval > 0 && cfg.BackupPath == "" {
+		return fmt.Errorf("no backup path")
+	}
+	if cfg.CrossValidate && len(cfg.Factomd) < 2 {
+		return fmt.Errorf(
+			"cross validation requires at least two factomd endpoints")
+	}
+	cfg.endpoints = newEndpoints(cfg.Factomd)
+
+	if err := cfg.checkNetworkID(ctx); err != nil {
+		return err
+	}
+
+	conn, err := sqlite.OpenConn(cfg.DBURI, 0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	conn.SetBusyTimeout(writeBusyTimeout)
+
+	// cancel stops the engine once a bounded scan is complete, or Stop
+	// is called.
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+	g, ctx := errgroup.WithContext(ctx)
+	conn.SetInterrupt(ctx.Done())
+
+	if cfg.Snapshot != "" {
+		if err := cfg.restoreSnapshot(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	err = db.Setup(conn, cfg.Speed, cfg.Log)
+	if err != nil {
+		return err
+	}
+	// The inserter checkpoints after each batch instead.
+	if err := db.SetAutoCheckpoint(conn, 0); err != nil {
+		return err
+	}
+
+	cfg.readers, err = db.OpenReadPool(cfg.DBURI, cfg.ReadPoolSize)
+	if err != nil {
+		return fmt.Errorf("db.OpenReadPool(): %w", err)
+	}
+	defer func() {
+		if err != nil {
+			cfg.readers.Close()
+		}
+	}()
+
+	syncHeight, err := db.SelectSyncHeight(conn)
+	if err != nil {
+		return err
+	}
+	if cfg.Prune && syncHeight > 0 {
+		// Prune any existing FBlocks before scanning, so that the
+		// inserter only ever prunes a few at a time.
+		n, err := db.PruneFBlocks(conn, 0, cfg.pruneBelow(syncHeight),
+			cfg.Log)
+		if err != nil {
+			return fmt.Errorf("db.PruneFBlocks(): %w", err)
+		}
+		if n > 0 {
+			cfg.Log.Info("pruned FBlocks", "count", n,
+				"keep", cfg.PruneKeep)
+		}
+	}
+	var backfill []db.Range
+	if syncHeight > 0 {
+		syncHeight++
+		if !cfg.Backfill && !cfg.ScanRange && cfg.StartScanHeight > 0 &&
+			cfg.StartScanHeight != syncHeight {
+			cfg.Log.Warn("ignoring start height for existing database",
+				"start", cfg.StartScanHeight, "resume", syncHeight)
+		}
+		if cfg.AutoStart {
+			cfg.Log.Warn("ignoring AutoStart for existing database")
+			cfg.AutoStart = false
+		}
+		syncHeight, backfill, err = cfg.resume(conn, syncHeight)
+		if err != nil {
+			return err
+		}
+	} else {
+		if cfg.AutoStart && len(cfg.Whitelist) == 0 {
+			return fmt.Errorf("AutoStart requires a Whitelist")
+		}
+		syncHeight = cfg.StartScanHeight
+	}
+	if cfg.StopHeight != nil && !cfg.ScanRange &&
+		syncHeight > *cfg.StopHeight {
+		return fmt.Errorf("database already synced past %v",
+			*cfg.StopHeight)
+	}
+
+	fblocks := make(chan fbPrice, 20)
+	committed := make(chan struct{}, 1)
+	g.Go(func() error {
+		// The inserter returns once the scan has completed and all
+		// fblocks are saved, which stops the rest of the engine.
+		defer cancel()
+		return cfg.fblockInserter(ctx, conn, fblocks, committed)
+	})
+	if len(cfg.Webhooks) > 0 {
+		g.Go(func() error { return cfg.notifyWebhooks(ctx, committed) })
+	}
+	g.Go(func() error { return cfg.scan(ctx, syncHeight, backfill, fblocks) })
+	if cfg.ListenAddr != "" {
+		g.Go(func() error { return cfg.serve(ctx) })
+	}
+	if cfg.BackupInterval > 0 {
+		g.Go(func() error { return cfg.backups(ctx) })
+	}
+
+	e.cancel = cancel
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		defer conn.Close()
+		defer cfg.readers.Close()
+		err := g.Wait()
+		if errors.Is(err, context.Canceled) {
+			err = nil
+		}
+		e.err = err
+	}()
+	return nil
+}
+
+// writeBusyTimeout is how long a read-write connection waits for the write
+// lock, which the inserter and the webhook notifier both take.
+const writeBusyTimeout = 10 * time.Second
+
+// resume returns the height from which to resume the scan of an existing
+// database, whose latest saved FBlock is below syncHeight, and any unscanned
+// ranges to backfill first.
+func (cfg Config) resume(conn *sqlite.Conn, syncHeight uint32) (uint32,
+	[]db.Range, error) {
+	from, to := uint32(0), syncHeight-1
+	if cfg.Backfill || cfg.ScanRange {
+		from = cfg.StartScanHeight
+	}
+	if cfg.ScanRange && cfg.StopHeight != nil && *cfg.StopHeight < to {
+		to = *cfg.StopHeight
+	}
+	gaps, err := db.SelectUnscannedRanges(conn, from, to)
+	if err != nil {
+		return 0, nil, fmt.Errorf("db.SelectUnscannedRanges(): %w", err)
+	}
+	switch {
+	case cfg.ScanRange:
+		// Scan the range above the latest saved FBlock, or only its
+		// gaps if it ends below.
+		if from > syncHeight {
+			syncHeight = from
+		} else if to < syncHeight-1 {
+			syncHeight = to + 1
+		}
+		return syncHeight, gaps, nil
+	case cfg.Backfill:
+		return syncHeight, gaps, nil
+	}
+	if len(cfg.Whitelist) > 0 && len(gaps) > 0 && gaps[0].Start == 0 {
+		// A whitelist database may intentionally start after the
+		// first use of its addresses, unless a backfill is requested.
+		gaps = gaps[1:]
+	}
+	if len(gaps) > 0 {
+		cfg.Log.Warn("database has unscanned heights, "+
+			"address balances are incomplete until backfilled",
+			"unscanned", fmt.Sprint(gaps))
+	}
+	return syncHeight, nil, nil
+}
+
+// Done returns a channel which is closed once the started engine has
+// stopped.
+func (e *Engine) Done() <-chan struct{} {
+	return e.done
+}
+
+// Wait blocks until the started engine has stopped and returns the terminal
+// error, which is nil if the engine was stopped by its context or Stop, or
+// completed its scan.
+func (e *Engine) Wait() error {
+	if e.done == nil {
+		return fmt.Errorf("engine not started")
+	}
+	<-e.done
+	return e.err
+}
+
+// Stop the started engine and return the result of Wait.
+func (e *Engine) Stop() error {
+	if e.cancel != nil {
+		e.cancel()
+	}
+	return e.Wait()
+}
+
+// Pause fetching new FBlocks. Any FBlocks already fetched are still saved.
+func (e *Engine) Pause() {
+	if e.cfg.pause.pause() {
+		e.cfg.Log.Info("scan paused")
+		e.cfg.progress.setPaused(true)
+	}
+}
+
+// Resume fetching FBlocks after Pause.
+func (e *Engine) Resume() {
+	if e.cfg.pause.resume() {
+		e.cfg.Log.Info("scan resumed")
+		e.cfg.progress.setPaused(false)
+	}
+}
+
+// Readers returns the pool of read-only database connections of the started
+// engine. Connections must be returned with Put, and must not be held
+// after the engine has stopped.
+func (e *Engine) Readers() *sqlitex.Pool {
+	return e.cfg.readers
+}
+
+// FBlockByHeight returns the saved FBlock at height using a read-only
+// connection of the started engine. If it has been pruned, the full FBlock
+// is fetched from factomd and verified against the saved KeyMR.
+func (e *Engine) FBlockByHeight(ctx context.Context,
+	height uint32) (factom.FBlock, error) {
+	if e.done == nil {
+		return factom.FBlock{}, fmt.Errorf("engine not started")
+	}
+	return e.cfg.selectFBlock(ctx, height)
+}
+
+// TransactionByHash returns the saved Transaction with txID using a
+// read-only connection of the started engine. If its FBlock has been pruned,
+// the full Transaction is fetched from factomd, unlike
+// db.SelectTransactionByHash which only returns its ledger data.
+func (e *Engine) TransactionByHash(ctx context.Context,
+	txID *factom.Bytes32) (factom.Transaction, error) {
+	if e.done == nil {
+		return factom.Transaction{}, fmt.Errorf("engine not started")
+	}
+	return e.cfg.selectTransaction(ctx, txID)
+}
+
+// Status returns the current SyncStatus.
+func (e *Engine) Status() SyncStatus {
+	return e.cfg.progress.get()
+}
+
+// Health returns the current HealthStatus, as reported by "/readyz".
+func (e *Engine) Health() HealthStatus {
+	return e.cfg.health.status(readyMaxAge + e.cfg.PollInterval)
+}
+
+// pauser gates the fetching of FBlocks.
+type pauser struct {
+	sync.Mutex
+	paused  chan struct{} // closed while paused
+	resumed chan struct{} // closed while not paused
+}
+
+func newPauser() *pauser {
+	p := pauser{paused: make(chan struct{}), resumed: make(chan struct{})}
+	close(p.resumed)
+	return &p
+}
+
+// pause returns false if already paused.
+func (p *pauser) pause() bool {
+	p.Lock()
+	defer p.Unlock()
+	select {
+	case <-p.paused:
+		return false
+	default:
+	}
+	close(p.paused)
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// resume returns false if not paused.
+func (p *pauser) resume() bool {
+	p.Lock()
+	defer p.Unlock()
+	select {
+	case <-p.resumed:
+		return false
+	default:
+	}
+	close(p.resumed)
+	p.paused = make(chan struct{})
+	return true
+}
+
+// pausedC returns a channel which is closed once paused.
+func (p *pauser) pausedC() <-chan struct{} {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+// wait blocks while paused, until resumed or ctx is done.
+func (p *pauser) wait(ctx context.Context) error {
+	p.Lock()
+	resumed := p.resumed
+	p.Unlock()
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPauser(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	p := newPauser()
+	require.NoError(p.wait(ctx), "not paused")
+	require.False(p.resume(), "not paused")
+
+	require.True(p.pause())
+	require.False(p.pause(), "already paused")
+	select {
+	case <-p.pausedC():
+	default:
+		require.Fail("pausedC not closed")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	require.Equal(context.DeadlineExceeded, p.wait(ctx), "paused")
+
+	waited := make(chan error)
+	go func() { waited <- p.wait(context.Background()) }()
+	require.True(p.resume())
+	require.NoError(<-waited, "resumed")
+	select {
+	case <-p.pausedC():
+		require.Fail("pausedC closed")
+	default:
+	}
+}
+
+func TestEngineNotStarted(t *testing.T) {
+	e := New(NewConfig())
+	require.EqualError(t, e.Wait(), "engine not started")
+	require.EqualError(t, e.Stop(), "engine not started")
+	_, err := e.FBlockByHeight(context.Background(), 0)
+	require.EqualError(t, err, "engine not started")
+	_, err = e.TransactionByHash(context.Background(), new(factom.Bytes32))
+	require.EqualError(t, err, "engine not started")
+	require.False(t, e.Status().Paused)
+	e.Pause()
+	require.True(t, e.Status().Paused)
+	e.Resume()
+	require.False(t, e.Status().Paused)
+}
+
+func TestResume(t *testing.T) {
+	require := require.New(t)
+	cfg, conn := setupInserter(t)
+
+	// Heights 3 through 5 are unscanned.
+	fbs := fakeFBlocks(t, 10)
+	for _, fbp := range append(fbs[:3:3], fbs[6:]...) {
+		require.NoError(db.InsertFBlock(conn, fbp.FBlock, 0,
+			db.CompressionNone, nil), "db.InsertFBlock()")
+	}
+
+	stop := func(height uint32) *uint32 { return &height }
+	for _, test := range []struct {
+		name        string
+		backfill    bool
+		scanRange   bool
+		from        uint32
+		to          *uint32
+		syncHeight  uint32
+		backfilling []db.Range
+	}{
+		{name: "resume", syncHeight: 10},
+		{name: "backfill", backfill: true, syncHeight: 10,
+			backfilling: []db.Range{{Start: 3, End: 5}}},
+		{name: "range to tip", scanRange: true, from: 4,
+			syncHeight: 10, backfilling: []db.Range{{Start: 4, End: 5}}},
+		{name: "range below", scanRange: true, from: 1, to: stop(4),
+			syncHeight: 5, backfilling: []db.Range{{Start: 3, End: 4}}},
+		{name: "range scanned", scanRange: true, from: 7, to: stop(8),
+			syncHeight: 9},
+		{name: "range above", scanRange: true, from: 15, to: stop(20),
+			syncHeight: 15},
+		{name: "range to 0", scanRange: true, from: 0, to: stop(0),
+			syncHeight: 1},
+	} {
+		cfg := cfg
+		cfg.Backfill, cfg.ScanRange = test.backfill, test.scanRange
+		cfg.StartScanHeight, cfg.StopHeight = test.from, test.to
+		syncHeight, backfill, err := cfg.resume(conn, 10)
+		require.NoError(err, test.name)
+		require.Equal(test.syncHeight, syncHeight, test.name)
+		require.Equal(test.backfilling, backfill, test.name)
+	}
+}
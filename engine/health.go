@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// health tracks the state reported by the "/healthz" and "/readyz"
+// endpoints.
+type health struct {
+	sync.RWMutex
+
+	// synced is set once the scan has caught up to the chain tip.
+	synced bool
+
+	// lastHeights is the time of the latest successful Heights.Get.
+	lastHeights time.Time
+	heights     factom.Heights
+}
+
+func (h *health) setSynced() {
+	h.Lock()
+	defer h.Unlock()
+	h.synced = true
+}
+
+func (h *health) heightsUpdated(heights factom.Heights) {
+	h.Lock()
+	defer h.Unlock()
+	h.lastHeights = time.Now()
+	h.heights = heights
+}
+
+// HealthStatus is the JSON body returned by the "/readyz" endpoint.
+type HealthStatus struct {
+	Ready       bool      `json:"ready"`
+	Synced      bool      `json:"synced"`
+	LastHeights time.Time `json:"last_heights"`
+
+	// FactomdSyncing is true while the connected factomd is behind the
+	// network leaders.
+	FactomdSyncing bool   `json:"factomd_syncing"`
+	DirectoryBlock uint32 `json:"directory_block_height"`
+	Leader         uint32 `json:"leader_height"`
+}
+
+// status returns the current HealthStatus. The engine is ready once synced,
+// factomd is not syncing, and the chain height has been refreshed within
+// maxAge.
+func (h *health) status(maxAge time.Duration) HealthStatus {
+	h.RLock()
+	defer h.RUnlock()
+	syncing := factomdSyncing(h.heights)
+	return HealthStatus{
+		Ready: h.synced && !syncing &&
+			time.Since(h.lastHeights) <= maxAge,
+		Synced:         h.synced,
+		LastHeights:    h.lastHeights,
+		FactomdSyncing: syncing,
+		DirectoryBlock: h.heights.DirectoryBlock,
+		Leader:         h.heights.Leader,
+	}
+}
+
+// readyMaxAge is the maximum time since the latest successful Heights.Get,
+// in addition to the PollInterval, for the engine to be considered ready.
+const readyMaxAge = 15 * time.Minute
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func (cfg Config) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	status := cfg.health.status(readyMaxAge + cfg.PollInterval)
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// chainTip returns the height of the latest FBlock available from factomd.
+//
+// FBlocks are saved along with their DBlock, so the DirectoryBlock height is
+// used. The EntryBlock height may lag far behind while factomd is syncing
+// entries, and is irrelevant to factoid data.
+func chainTip(heights factom.Heights) uint32 {
+	return heights.DirectoryBlock
+}
+
+// isChainTip returns true if the FBlock at height is the latest on the
+// network, which is only known once factomd is synced.
+func isChainTip(heights factom.Heights, height uint32) bool {
+	return height == chainTip(heights) && !factomdSyncing(heights)
+}
+
+// scanTip returns the chainTip, or cfg.StopHeight if it is lower.
+func (cfg Config) scanTip(heights factom.Heights) uint32 {
+	tip := chainTip(heights)
+	if cfg.StopHeight != nil && *cfg.StopHeight < tip {
+		return *cfg.StopHeight
+	}
+	return tip
+}
+
+// factomdSyncing returns true if factomd has not yet saved all DBlocks
+// prior to the block being worked on by the network leaders.
+//
+// The leaders are always working on the block after the latest saved DBlock,
+// so a factomd that is caught up has a Leader height of DirectoryBlock+1.
+// A Leader height of 0 means factomd does not yet know of the network and
+// is also treated as syncing.
+func factomdSyncing(heights factom.Heights) bool {
+	return heights.Leader == 0 ||
+		heights.Leader > heights.DirectoryBlock+1
+}
+
+// getHeights populates heights from factomd.
+//
+// Unlike other requests, failures are retried until ctx is done, rather than
+// according to cfg.Retry, at least every cfg.PollInterval, since the scan
+// cannot proceed without the chain height and factomd may be restarting.
+func (cfg Config) getHeights(ctx context.Context,
+	heights *factom.Heights) error {
+	cfg.Retry = unboundedRetryPolicy(cfg.PollInterval)
+	if err := cfg.factomd(ctx, "heights", func(c *factom.Client) error {
+		return heights.Get(ctx, c)
+	}); err != nil {
+		return fmt.Errorf("factom.Heights.Get(): %w", err)
+	}
+	cfg.metrics.setChainHeight(chainTip(*heights))
+	cfg.health.heightsUpdated(*heights)
+	return nil
+}
@@ -0,0 +1,19 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsChainTip(t *testing.T) {
+	require := require.New(t)
+
+	synced := factom.Heights{DirectoryBlock: 10, Leader: 11}
+	require.True(isChainTip(synced, 10))
+	require.False(isChainTip(synced, 9))
+
+	syncing := factom.Heights{DirectoryBlock: 10, Leader: 20}
+	require.False(isChainTip(syncing, 10), "factomd syncing")
+}
@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metrics collects the values exported on the "/metrics" endpoint in the
+// Prometheus text exposition format.
+type metrics struct {
+	sync.Mutex
+
+	syncHeight   uint32
+	chainHeight  uint32
+	blocksTotal  uint64
+	blocksPerSec float64
+	dbSize       int64
+	walPages     int
+
+	priceErrors uint64
+
+	insertBatch summary
+
+	factomdLatency map[string]*summary
+	factomdErrors  map[string]uint64
+}
+
+// summary tracks the count and cumulative sum of observations.
+type summary struct {
+	Count uint64
+	Sum   float64
+}
+
+func (s *summary) observe(d time.Duration) {
+	s.Count++
+	s.Sum += d.Seconds()
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		factomdLatency: make(map[string]*summary),
+		factomdErrors:  make(map[string]uint64),
+	}
+}
+
+func (m *metrics) setWALPages(pages int) {
+	m.Lock()
+	defer m.Unlock()
+	m.walPages = pages
+}
+
+// observeFactomd records the latency of a factomd call to method, and counts
+// it as an error if err is not nil.
+func (m *metrics) observeFactomd(method string, start time.Time, err error) {
+	d := time.Since(start)
+	m.Lock()
+	defer m.Unlock()
+	s, ok := m.factomdLatency[method]
+	if !ok {
+		s = new(summary)
+		m.factomdLatency[method] = s
+	}
+	s.observe(d)
+	if err != nil {
+		m.factomdErrors[method]++
+	}
+}
+
+func (m *metrics) setChainHeight(height uint32) {
+	m.Lock()
+	defer m.Unlock()
+	m.chainHeight = height
+}
+
+func (m *metrics) incPriceErrors() {
+	m.Lock()
+	defer m.Unlock()
+	m.priceErrors++
+}
+
+// observeBatch records the insertion of a batch of n FBlocks up to height
+// which took d to complete.
+func (m *metrics) observeBatch(height uint32, n int, d time.Duration,
+	dbSize int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.syncHeight = height
+	m.blocksTotal += uint64(n)
+	if d > 0 {
+		m.blocksPerSec = float64(n) / d.Seconds()
+	}
+	m.insertBatch.observe(d)
+	m.dbSize = dbSize
+}
+
+const metricsPrefix = "fblock_scan_"
+
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	var p promWriter
+	p.gauge("sync_height", "Height of the latest FBlock saved to the database.",
+		float64(m.syncHeight))
+	p.gauge("chain_height", "Height of the latest DBlock reported by factomd.",
+		float64(m.chainHeight))
+	p.counter("blocks_inserted_total",
+		"Total number of FBlocks inserted since start.",
+		float64(m.blocksTotal))
+	p.gauge("blocks_per_second", "FBlock insert rate of the latest batch.",
+		m.blocksPerSec)
+	p.gauge("db_size_bytes", "Size of the SQLite database.",
+		float64(m.dbSize))
+	p.gauge("wal_pages", "Number of pages in the SQLite WAL after the latest checkpoint.",
+		float64(m.walPages))
+	p.counter("price_errors_total",
+		"Total number of failed price API lookups.",
+		float64(m.priceErrors))
+	p.summary("insert_batch_duration_seconds",
+		"Time taken to insert and commit a batch of FBlocks.",
+		"", m.insertBatch)
+
+	methods := make([]string, 0, len(m.factomdLatency))
+	for method := range m.factomdLatency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	p.header("factomd_request_duration_seconds", "summary",
+		"Latency of factomd API requests.")
+	for _, method := range methods {
+		p.summaryValues("factomd_request_duration_seconds",
+			fmt.Sprintf("{method=%q}", method), *m.factomdLatency[method])
+	}
+	p.header("factomd_errors_total", "counter",
+		"Total number of failed factomd API requests.")
+	for _, method := range methods {
+		p.value("factomd_errors_total", fmt.Sprintf("{method=%q}", method),
+			float64(m.factomdErrors[method]))
+	}
+
+	n, err := w.Write(p.buf)
+	return int64(n), err
+}
+
+func (cfg Config) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := cfg.metrics.WriteTo(w); err != nil {
+		cfg.Log.Warn("metrics", "err", err)
+	}
+}
+
+// promWriter formats metrics in the Prometheus text exposition format.
+type promWriter struct {
+	buf []byte
+}
+
+func (p *promWriter) header(name, typ, help string) {
+	p.buf = append(p.buf, fmt.Sprintf("# HELP %v%v %v\n# TYPE %v%v %v\n",
+		metricsPrefix, name, help, metricsPrefix, name, typ)...)
+}
+func (p *promWriter) value(name, labels string, v float64) {
+	p.buf = append(p.buf, fmt.Sprintf("%v%v%v %v\n",
+		metricsPrefix, name, labels, v)...)
+}
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.value(name, "", v)
+}
+func (p *promWriter) counter(name, help string, v float64) {
+	p.header(name, "counter", help)
+	p.value(name, "", v)
+}
+func (p *promWriter) summary(name, help, labels string, s summary) {
+	p.header(name, "summary", help)
+	p.summaryValues(name, labels, s)
+}
+func (p *promWriter) summaryValues(name, labels string, s summary) {
+	p.value(name+"_sum", labels, s.Sum)
+	p.value(name+"_count", labels, float64(s.Count))
+}
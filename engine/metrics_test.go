@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	require := require.New(t)
+
+	m := newMetrics()
+	m.setChainHeight(200)
+	m.observeBatch(100, 10, 2*time.Second, 4096)
+	m.setWALPages(3)
+	m.incPriceErrors()
+	start := time.Now()
+	m.observeFactomd("heights", start, nil)
+	m.observeFactomd("fblock", start, errors.New("timeout"))
+	m.observeFactomd("fblock", start, nil)
+
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	require.NoError(err, "WriteTo()")
+	require.EqualValues(buf.Len(), n)
+
+	// Latencies vary, so only their count is checked.
+	for _, line := range []string{
+		"# HELP fblock_scan_sync_height Height of the latest FBlock saved to the database.",
+		"# TYPE fblock_scan_sync_height gauge",
+		"fblock_scan_sync_height 100",
+		"fblock_scan_chain_height 200",
+		"# TYPE fblock_scan_blocks_inserted_total counter",
+		"fblock_scan_blocks_inserted_total 10",
+		"fblock_scan_blocks_per_second 5",
+		"fblock_scan_db_size_bytes 4096",
+		"fblock_scan_wal_pages 3",
+		"fblock_scan_price_errors_total 1",
+		"# TYPE fblock_scan_insert_batch_duration_seconds summary",
+		"fblock_scan_insert_batch_duration_seconds_sum 2",
+		"fblock_scan_insert_batch_duration_seconds_count 1",
+		"# TYPE fblock_scan_factomd_request_duration_seconds summary",
+		`fblock_scan_factomd_request_duration_seconds_count{method="fblock"} 2`,
+		`fblock_scan_factomd_request_duration_seconds_count{method="heights"} 1`,
+		"# TYPE fblock_scan_factomd_errors_total counter",
+		`fblock_scan_factomd_errors_total{method="fblock"} 1`,
+		`fblock_scan_factomd_errors_total{method="heights"} 0`,
+	} {
+		require.Contains(buf.String(), fmt.Sprintln(line))
+	}
+
+	// Labeled values are sorted by method.
+	require.Less(bytes.Index(buf.Bytes(), []byte(`{method="fblock"}`)),
+		bytes.Index(buf.Bytes(), []byte(`{method="heights"}`)))
+
+	cfg := NewConfig()
+	cfg.metrics = m
+	w := httptest.NewRecorder()
+	cfg.serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal("text/plain; version=0.0.4", w.Header().Get("Content-Type"))
+	require.Equal(buf.String(), w.Body.String())
+}
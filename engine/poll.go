@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"time"
+)
+
+// pollHistory is the number of recent DBlock timestamps used to predict the
+// next block.
+const pollHistory = 6
+
+// poller decides how long to wait before next checking factomd for a new
+// block once synced.
+type poller struct {
+	interval time.Duration
+	adaptive bool
+
+	// timestamps of the most recent DBlocks, oldest first.
+	timestamps []time.Time
+}
+
+// observe records the timestamp of a newly synced DBlock.
+func (p *poller) observe(ts time.Time) {
+	p.timestamps = append(p.timestamps, ts)
+	if len(p.timestamps) > pollHistory {
+		p.timestamps = p.timestamps[1:]
+	}
+}
+
+// wait returns the duration to wait from now until the next poll.
+//
+// If adaptive, the poller waits until the next block is predicted to arrive,
+// and then polls every interval once it is overdue, or if not adaptive.
+//
+// A DBlock timestamp marks the start of its block period, and the DBlock is
+// only available once the period ends, one average block time later. So the
+// block after the latest one is predicted to arrive two average block times
+// after the latest timestamp.
+func (p *poller) wait(now time.Time) time.Duration {
+	if !p.adaptive || len(p.timestamps) < 2 {
+		return p.interval
+	}
+	first, last := p.timestamps[0], p.timestamps[len(p.timestamps)-1]
+	avg := last.Sub(first) / time.Duration(len(p.timestamps)-1)
+	wait := last.Add(2 * avg).Sub(now)
+	if wait < p.interval {
+		return p.interval
+	}
+	return wait
+}
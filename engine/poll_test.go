@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoller(t *testing.T) {
+	require := require.New(t)
+
+	p := poller{interval: 15 * time.Second, adaptive: true}
+	start := time.Date(2020, 2, 20, 18, 0, 0, 0, time.UTC)
+	p.observe(start)
+	require.Equal(p.interval, p.wait(start), "insufficient history")
+
+	// The period of the latest DBlock ended shortly before now, so the
+	// next DBlock is expected two block times after its timestamp.
+	for i := 1; i <= pollHistory; i++ {
+		p.observe(start.Add(time.Duration(i) * 10 * time.Minute))
+	}
+	require.Len(p.timestamps, pollHistory)
+	latest := start.Add(pollHistory * 10 * time.Minute)
+	now := latest.Add(10*time.Minute + 5*time.Second)
+	require.Equal(10*time.Minute-5*time.Second, p.wait(now))
+
+	// Overdue.
+	require.Equal(p.interval, p.wait(latest.Add(21*time.Minute)))
+
+	p.adaptive = false
+	require.Equal(p.interval, p.wait(now))
+}
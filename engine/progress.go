@@ -0,0 +1,134 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SyncStatus reports the progress of the scan. It is passed to
+// Config.OnProgress, and returned by Engine.Status and the "/status"
+// endpoint.
+type SyncStatus struct {
+	// Height is the latest committed height.
+	Height uint32 `json:"height"`
+
+	// Tip is the height the scan is working towards, which is the chain
+	// tip, or StopHeight if it is lower.
+	Tip uint32 `json:"tip"`
+
+	// Done is the number of heights up to Tip which have been scanned,
+	// out of Total.
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+
+	// Rate is the recent number of FBlocks saved per second.
+	Rate float64 `json:"rate"`
+
+	// ETA is the estimated time remaining until Tip is reached, based on
+	// Rate. It is 0 if unknown or synced. It is encoded in JSON as
+	// nanoseconds.
+	ETA time.Duration `json:"eta"`
+
+	// Synced is set once the scan has caught up to the chain tip.
+	Synced bool `json:"synced"`
+
+	// Paused is set while fetching new FBlocks is paused.
+	Paused bool `json:"paused"`
+}
+
+// progressRateWeight is the weight of each new batch in the moving average
+// of SyncStatus.Rate.
+const progressRateWeight = 0.2
+
+// progress tracks the SyncStatus and reports each update to onUpdate.
+type progress struct {
+	sync.Mutex
+	status   SyncStatus
+	onUpdate func(SyncStatus)
+
+	// last is the time of the latest committed batch.
+	last time.Time
+}
+
+// start resets the status for a scan to tip with done heights already
+// scanned.
+func (p *progress) start(tip uint32, done int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Tip = tip
+	p.status.Total = int64(tip) + 1
+	p.status.Done = done
+	p.last = time.Now()
+	p.update()
+}
+
+// setTip updates the Tip.
+func (p *progress) setTip(tip uint32) {
+	p.Lock()
+	defer p.Unlock()
+	if tip == p.status.Tip {
+		return
+	}
+	p.status.Tip = tip
+	p.status.Total = int64(tip) + 1
+	p.update()
+}
+
+// committed records that n FBlocks up to height have been committed.
+func (p *progress) committed(height uint32, n int) {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	if d := now.Sub(p.last).Seconds(); d > 0 {
+		rate := float64(n) / d
+		if p.status.Rate == 0 {
+			p.status.Rate = rate
+		} else {
+			p.status.Rate += progressRateWeight * (rate - p.status.Rate)
+		}
+	}
+	p.last = now
+	p.status.Height = height
+	p.status.Done += int64(n)
+	p.update()
+}
+
+func (p *progress) setSynced() {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Synced = true
+	p.update()
+}
+
+func (p *progress) setPaused(paused bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.status.Paused = paused
+	p.update()
+}
+
+// update recomputes the ETA and calls onUpdate. The lock must be held.
+func (p *progress) update() {
+	p.status.ETA = 0
+	if remaining := p.status.Total - p.status.Done; !p.status.Synced &&
+		remaining > 0 && p.status.Rate > 0 {
+		p.status.ETA = time.Duration(float64(remaining) /
+			p.status.Rate * float64(time.Second))
+	}
+	if p.onUpdate != nil {
+		p.onUpdate(p.status)
+	}
+}
+
+func (p *progress) get() SyncStatus {
+	p.Lock()
+	defer p.Unlock()
+	return p.status
+}
+
+func (cfg Config) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg.progress.get())
+}
@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	require := require.New(t)
+
+	var updates []SyncStatus
+	p := progress{onUpdate: func(s SyncStatus) { updates = append(updates, s) }}
+
+	p.start(99, 50)
+	require.Len(updates, 1)
+	require.EqualValues(100, updates[0].Total)
+	require.EqualValues(50, updates[0].Done)
+	require.Zero(updates[0].ETA, "unknown rate")
+
+	p.last = time.Now().Add(-time.Second)
+	p.committed(59, 10)
+	status := p.get()
+	require.EqualValues(59, status.Height)
+	require.EqualValues(60, status.Done)
+	require.InDelta(10, status.Rate, 1)
+	require.InDelta(4*time.Second, status.ETA, float64(time.Second))
+
+	p.setTip(99)
+	require.Len(updates, 2, "unchanged tip")
+	p.setTip(199)
+	require.EqualValues(200, p.get().Total)
+
+	p.setSynced()
+	require.True(p.get().Synced)
+	require.Zero(p.get().ETA, "synced")
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
+)
+
+// pruneBelow returns the height below which FBlocks are pruned once height
+// is saved, so that only the latest cfg.PruneKeep FBlocks keep their data.
+func (cfg Config) pruneBelow(height uint32) uint32 {
+	if height+1 < cfg.PruneKeep {
+		return 0
+	}
+	return height + 1 - cfg.PruneKeep
+}
+
+// prune prunes the FBlock just inserted at height if it is not among the
+// latest cfg.PruneKeep FBlocks, such as when backfilling, and the FBlock
+// which is no longer among them. top is the latest saved height.
+func (cfg Config) prune(conn *sqlite.Conn, height uint32, top *uint32) error {
+	if height > *top {
+		*top = height
+	}
+	below := cfg.pruneBelow(*top)
+	if height < below {
+		if _, err := db.PruneFBlocks(conn, height, height+1,
+			cfg.Log); err != nil {
+			return fmt.Errorf("db.PruneFBlocks(): %w", err)
+		}
+	}
+	if height == *top && below > 0 {
+		if _, err := db.PruneFBlocks(conn, below-1, below,
+			cfg.Log); err != nil {
+			return fmt.Errorf("db.PruneFBlocks(): %w", err)
+		}
+	}
+	return nil
+}
+
+// fetchPrunedFBlock fetches the full FBlock from factomd for the header of
+// a pruned FBlock, as returned by db.SelectFBlockByHeight along with
+// db.ErrPrunedFBlock. The FBlock is verified against the saved KeyMR.
+func (cfg Config) fetchPrunedFBlock(ctx context.Context,
+	pruned factom.FBlock) (factom.FBlock, error) {
+	keyMR := *pruned.KeyMR
+	var fb factom.FBlock
+	if err := cfg.factomd(ctx, "fblock", func(c *factom.Client) error {
+		// A failed attempt may leave fb partially populated, which
+		// factom.FBlock.Get would not fetch again, so each attempt
+		// starts over. The Timestamp must be set prior to
+		// unmarshaling so that the Transaction Timestamps are
+		// populated.
+		fb = factom.FBlock{KeyMR: new(factom.Bytes32),
+			Timestamp: pruned.Timestamp}
+		*fb.KeyMR = keyMR
+		return fb.Get(ctx, c)
+	}); err != nil {
+		return fb, fmt.Errorf("factom.FBlock.Get(): %w", err)
+	}
+	if *fb.KeyMR != keyMR || fb.Height != pruned.Height {
+		return fb, fmt.Errorf("FBlock %v: KeyMR mismatch from factomd",
+			pruned.Height)
+	}
+	return fb, nil
+}
+
+// selectFBlock returns the saved FBlock at height, fetching it from factomd
+// if it has been pruned.
+func (cfg Config) selectFBlock(ctx context.Context,
+	height uint32) (factom.FBlock, error) {
+	var fb factom.FBlock
+	var pruned bool
+	if err := cfg.withReader(ctx, func(conn *sqlite.Conn) (err error) {
+		fb, err = db.SelectFBlockByHeight(conn, height)
+		if errors.Is(err, db.ErrPrunedFBlock) {
+			pruned, err = true, nil
+		}
+		if err != nil {
+			return fmt.Errorf("db.SelectFBlockByHeight(): %w", err)
+		}
+		return nil
+	}); err != nil {
+		return fb, err
+	}
+	if !pruned {
+		return fb, nil
+	}
+	return cfg.fetchPrunedFBlock(ctx, fb)
+}
+
+// selectTransaction returns the saved Transaction with txID. If its FBlock
+// has been pruned, the full Transaction, including its Signatures, is
+// fetched from factomd.
+func (cfg Config) selectTransaction(ctx context.Context,
+	txID *factom.Bytes32) (factom.Transaction, error) {
+	var tx factom.Transaction
+	var fb factom.FBlock
+	var pruned bool
+	if err := cfg.withReader(ctx, func(conn *sqlite.Conn) error {
+		height, p, err := db.SelectTransactionHeight(conn, txID)
+		if err != nil {
+			return fmt.Errorf("db.SelectTransactionHeight(): %w", err)
+		}
+		if pruned = p; !pruned {
+			tx, err = db.SelectTransactionByHash(conn, txID)
+			if err != nil {
+				return fmt.Errorf(
+					"db.SelectTransactionByHash(): %w", err)
+			}
+			return nil
+		}
+		fb, err = db.SelectFBlockByHeight(conn, height)
+		if err != nil && !errors.Is(err, db.ErrPrunedFBlock) {
+			return fmt.Errorf("db.SelectFBlockByHeight(): %w", err)
+		}
+		return nil
+	}); err != nil {
+		return tx, err
+	}
+	if !pruned {
+		return tx, nil
+	}
+
+	fb, err := cfg.fetchPrunedFBlock(ctx, fb)
+	if err != nil {
+		return tx, err
+	}
+	for _, tx := range fb.Transactions {
+		if *tx.ID == *txID {
+			return tx, nil
+		}
+	}
+	return tx, fmt.Errorf("no Transaction found in FBlock %v", fb.Height)
+}
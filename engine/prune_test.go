@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+// serveRawData points cfg at a fake factomd which responds to "raw-data"
+// requests with the data in rawData for the requested hash.
+func serveRawData(t *testing.T, cfg *Config,
+	rawData map[factom.Bytes32]factom.Bytes) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				ID     json.RawMessage `json:"id"`
+				Params struct {
+					Hash factom.Bytes32 `json:"hash"`
+				} `json:"params"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"jsonrpc": "2.0", "id": req.ID,
+				"result": map[string]interface{}{
+					"data": rawData[req.Params.Hash]},
+			})
+		}))
+	t.Cleanup(srv.Close)
+	cfg.endpoints = newEndpoints([]string{srv.URL})
+	cfg.Retry = NewRetryPolicy(1, time.Second)
+}
+
+// TestFetchPrunedFBlock fetches pruned FBlocks from a fake factomd, and checks
+// that an FBlock which does not match the saved KeyMR is rejected.
+func TestFetchPrunedFBlock(t *testing.T) {
+	require := require.New(t)
+	cfg, _ := setupInserter(t)
+
+	fbs := fakeFBlocks(t, 2)
+	pruned := fbs[1].FBlock
+	data, err := pruned.MarshalBinary()
+	require.NoError(err)
+	rawData := map[factom.Bytes32]factom.Bytes{*pruned.KeyMR: data}
+	serveRawData(t, &cfg, rawData)
+
+	fb, err := cfg.fetchPrunedFBlock(context.Background(), pruned)
+	require.NoError(err)
+	require.Equal(*pruned.KeyMR, *fb.KeyMR)
+
+	rawData[*pruned.KeyMR], err = fbs[0].FBlock.MarshalBinary()
+	require.NoError(err)
+	_, err = cfg.fetchPrunedFBlock(context.Background(), pruned)
+	require.EqualError(err, "factom.FBlock.Get(): invalid keyMR")
+	require.Equal(*fbs[1].FBlock.KeyMR, *pruned.KeyMR, "saved KeyMR")
+}
+
+// TestSelectPruned queries pruned and unpruned FBlocks and Transactions, and
+// checks that the pruned ones are fetched from factomd in full.
+func TestSelectPruned(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "test.sqlite3")
+	conn, err := sqlite.OpenConn(path, 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(db.Setup(conn, false, log.Logger{}), "db.Setup()")
+	fbs := fakeFBlocks(t, 3)
+	rawData := make(map[factom.Bytes32]factom.Bytes)
+	for _, fbp := range fbs {
+		require.NoError(db.InsertFBlock(conn, fbp.FBlock, 1,
+			db.CompressionNone, nil), "db.InsertFBlock()")
+		rawData[*fbp.KeyMR], err = fbp.MarshalBinary()
+		require.NoError(err)
+	}
+	_, err = db.PruneFBlocks(conn, 0, 2, log.Logger{})
+	require.NoError(err, "db.PruneFBlocks()")
+
+	cfg := NewConfig()
+	cfg.readers, err = db.OpenReadPool(path, 1)
+	require.NoError(err, "db.OpenReadPool()")
+	defer cfg.readers.Close()
+	serveRawData(t, &cfg, rawData)
+
+	for _, fbp := range fbs {
+		fb, err := cfg.selectFBlock(ctx, fbp.Height)
+		require.NoError(err, "height %v", fbp.Height)
+		require.Equal(*fbp.KeyMR, *fb.KeyMR)
+		require.Len(fb.Transactions, len(fbp.Transactions))
+
+		for _, want := range fbp.Transactions {
+			tx, err := cfg.selectTransaction(ctx, want.ID)
+			require.NoError(err, "height %v", fbp.Height)
+			require.Equal(*want.ID, *tx.ID)
+			require.Equal(want.Signatures, tx.Signatures,
+				"height %v", fbp.Height)
+		}
+	}
+
+	// Only the pruned FBlocks are fetched.
+	delete(rawData, *fbs[2].KeyMR)
+	_, err = cfg.selectFBlock(ctx, fbs[2].Height)
+	require.NoError(err, "not pruned")
+	delete(rawData, *fbs[0].KeyMR)
+	_, err = cfg.selectFBlock(ctx, fbs[0].Height)
+	require.Error(err, "pruned")
+}
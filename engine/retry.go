@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AdamSLevy/jsonrpc2/v13"
+	"github.com/AdamSLevy/retry"
+	"github.com/Factom-Asset-Tokens/factom"
+)
+
+// NewRetryPolicy returns an exponential backoff retry.Policy which gives up
+// after the given number of attempts or total time, whichever comes first.
+func NewRetryPolicy(attempts uint, total time.Duration) retry.Policy {
+	return retry.LimitTotal{Limit: total,
+		Policy: retry.LimitAttempts{Limit: attempts,
+			Policy: retry.Max{Cap: 2 * time.Minute,
+				Policy: retry.Randomize{Factor: .25,
+					Policy: retry.Exponential{
+						Initial:    2 * time.Second,
+						Multiplier: 1.3}}}}}
+}
+
+// unboundedRetryPolicy returns an exponential backoff retry.Policy which
+// never gives up, and waits at most max between attempts.
+func unboundedRetryPolicy(max time.Duration) retry.Policy {
+	return retry.Max{Cap: max,
+		Policy: retry.Randomize{Factor: .25,
+			Policy: retry.Exponential{
+				Initial:    2 * time.Second,
+				Multiplier: 1.3}}}
+}
+
+// PermanentError wraps an error which will not succeed if retried.
+type PermanentError struct{ Err error }
+
+func (err PermanentError) Error() string { return err.Err.Error() }
+func (err PermanentError) Unwrap() error { return err.Err }
+
+// isPermanent returns true if err will not succeed if retried.
+//
+// JSON-RPC errors indicating a malformed request are permanent. All other
+// errors, including network errors, HTTP errors, JSON-RPC internal errors,
+// and factomd's own errors such as "Not found" for a block that a syncing
+// node does not yet have, are considered transient.
+func isPermanent(err error) bool {
+	var permErr PermanentError
+	if errors.As(err, &permErr) {
+		return true
+	}
+	var rpcErr jsonrpc2.Error
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.Code {
+		case jsonrpc2.ErrorCodeParse,
+			jsonrpc2.ErrorCodeInvalidRequest,
+			jsonrpc2.ErrorCodeMethodNotFound,
+			jsonrpc2.ErrorCodeInvalidParams:
+			return true
+		}
+	}
+	return false
+}
+
+// classify is a retry.Run filter which stops retrying permanent errors.
+func classify(err error) error {
+	if err != nil && isPermanent(err) {
+		return retry.ErrorStop(err)
+	}
+	return err
+}
+
+// factomd calls op, which makes a request to factomd for method using the
+// given Client, retrying transient errors according to cfg.Retry. Each
+// attempt uses the next healthy endpoint. The latency and any error of each
+// attempt is recorded in cfg.metrics.
+func (cfg Config) factomd(ctx context.Context,
+	method string, op func(*factom.Client) error) error {
+	_, err := cfg.factomdExcept(ctx, method, nil, op)
+	return err
+}
+
+// factomdExcept is like factomd but never uses the endpoint except. It
+// returns the Client used by the final attempt.
+func (cfg Config) factomdExcept(ctx context.Context, method string,
+	except *factom.Client, op func(*factom.Client) error) (*factom.Client, error) {
+	var c *factom.Client
+	err := retry.Run(ctx, cfg.Retry, classify,
+		func(err error, n uint, next time.Duration) {
+			cfg.Log.Warn("factomd request failed", "method", method,
+				"factomd", c.FactomdServer, "err", err,
+				"attempts", n, "next", next)
+		},
+		func() error {
+			ep := cfg.endpoints.pick(except)
+			if ep == nil {
+				return PermanentError{fmt.Errorf(
+					"no other factomd endpoint for %v", method)}
+			}
+			c = ep.Client
+
+			start := time.Now()
+			err := op(c)
+			cfg.metrics.observeFactomd(method, start, err)
+
+			// The endpoint is healthy if it responded at all.
+			healthy := err == nil || isPermanent(err)
+			if !cfg.endpoints.report(ep, healthy) {
+				return err
+			}
+			if healthy {
+				cfg.Log.Info("factomd endpoint recovered",
+					"factomd", c.FactomdServer)
+			} else {
+				cfg.Log.Warn("factomd endpoint down",
+					"factomd", c.FactomdServer)
+			}
+			return err
+		})
+	return c, err
+}
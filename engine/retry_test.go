@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdamSLevy/jsonrpc2/v13"
+	"github.com/AdamSLevy/retry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnboundedRetryPolicy(t *testing.T) {
+	p := unboundedRetryPolicy(15 * time.Second)
+	for _, attempts := range []uint{1, 10, 1000} {
+		wait := p.Wait(attempts, 24*time.Hour)
+		require.NotEqual(t, retry.Stop, wait, "attempts: %v", attempts)
+		require.LessOrEqual(t, int64(wait), int64(15*time.Second))
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	for _, test := range []struct {
+		Err       error
+		Permanent bool
+	}{
+		{errors.New("connection refused"), false},
+		{jsonrpc2.Error{Code: -32008, Message: "Not found"}, false},
+		{jsonrpc2.Error{Code: jsonrpc2.ErrorCodeInternal}, false},
+		{jsonrpc2.Error{Code: jsonrpc2.ErrorCodeMethodNotFound}, true},
+		{fmt.Errorf("wrapped: %w",
+			jsonrpc2.Error{Code: jsonrpc2.ErrorCodeInvalidParams}), true},
+		{PermanentError{errors.New("wrong network")}, true},
+	} {
+		require.Equal(t, test.Permanent, isPermanent(test.Err), test.Err)
+	}
+}
@@ -2,9 +2,7 @@ package engine
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"log"
 	"time"
 
 	"crawshaw.io/sqlite"
@@ -12,137 +10,184 @@ import (
 	"github.com/AdamSLevy/retry"
 	"github.com/Factom-Asset-Tokens/factom"
 	"github.com/canonical-ledgers/fblock-scan/db"
-	"github.com/cheggaaa/pb/v3"
-	"golang.org/x/sync/errgroup"
 )
 
-func (cfg Config) Start(ctx context.Context) (_ <-chan struct{}, err error) {
+// scan sends each FBlock in the backfill ranges, and then each FBlock from
+// syncHeight onward, to fblocks, which is closed on return.
+func (cfg Config) scan(ctx context.Context, syncHeight uint32,
+	backfill []db.Range, fblocks chan<- fbPrice) error {
+	defer close(fblocks)
 
-	if err := cfg.checkNetworkID(ctx); err != nil {
-		return nil, err
-	}
+	// synced tracks whether we have completed our first sync.
+	var synced bool
 
-	conn, err := sqlite.OpenConn(cfg.DBURI, 0)
-	if err != nil {
-		return nil, err
-	}
-	g, ctx := errgroup.WithContext(ctx)
-	conn.SetInterrupt(ctx.Done())
+	// waiting tracks whether we have logged that factomd is syncing.
+	var waiting bool
 
-	err = db.Setup(conn, cfg.Speed)
-	if err != nil {
-		return nil, err
+	var heights factom.Heights
+	if err := cfg.getHeights(ctx, &heights); err != nil {
+		return err
 	}
+	tip := cfg.scanTip(heights)
 
-	syncHeight, err := db.SelectSyncHeight(conn)
-	if err != nil {
-		return nil, err
-	}
-	if syncHeight > 0 {
-		syncHeight++
-	} else {
-		syncHeight = cfg.StartScanHeight
+	if cfg.AutoStart {
+		var err error
+		syncHeight, err = cfg.discoverStartHeight(ctx, syncHeight, tip)
+		if err != nil {
+			return err
+		}
 	}
 
-	cfg.syncBar = pb.New(0)
-
-	fblocks := make(chan fbPrice, 20)
-	g.Go(func() error { return cfg.fblockInserter(ctx, conn, fblocks) })
-	g.Go(func() error { return cfg.scan(ctx, syncHeight, fblocks) })
+	var backfillLen int64
+	for _, r := range backfill {
+		backfillLen += r.Len()
+	}
+	cfg.progress.start(tip, int64(syncHeight)-backfillLen)
 
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		defer conn.Close()
-		if err := g.Wait(); err != nil {
-			if !errors.Is(err, context.Canceled) {
-				log.Println("Error: ", err)
+	// Fill any unscanned ranges below syncHeight first.
+	for _, r := range backfill {
+		cfg.Log.Info("backfilling", "from", r.Start, "to", r.End)
+		for height := int64(r.Start); height <= int64(r.End); height++ {
+			if _, err := cfg.syncFBlock(ctx, uint32(height), false,
+				fblocks); err != nil {
+				return err
 			}
 		}
-	}()
-	return done, nil
-}
-func (cfg Config) scan(ctx context.Context, syncHeight uint32,
-	fblocks chan<- fbPrice) error {
-
-	// synced tracks whether we have completed our first sync.
-	var synced bool
-
-	var heights factom.Heights
-	if err := heights.Get(ctx, cfg.C); err != nil {
-		return fmt.Errorf("factom.Heights.Get(): %v", err)
 	}
 
-	cfg.syncBar.SetTotal(int64(heights.EntryBlock))
-	cfg.syncBar.Add(int(int32(syncHeight - 1)))
-	cfg.syncBar.Start()
+	cfg.Log.Info("scanning", "from", syncHeight, "to", tip)
 
-	// scanTicker kicks off a new scan.
-	scanTicker := time.NewTicker(5 * time.Minute)
+	// refreshTicker refreshes the chain height during a sync.
+	refreshTicker := time.NewTicker(cfg.RefreshInterval)
+	defer refreshTicker.Stop()
+
+	// poll decides when to check for new blocks once synced.
+	poll := poller{interval: cfg.PollInterval, adaptive: cfg.AdaptivePolling}
+	pollTimer := time.NewTimer(0)
+	defer pollTimer.Stop()
 
-	defer fmt.Println()
 	// Factom Blockchain Scan Loop
 	for {
-		if !synced && syncHeight == heights.EntryBlock {
-			synced = true
-			cfg.syncBar.Finish()
-			fmt.Printf("FBlock scan complete to block %v.", syncHeight)
-		}
 		// Process all new DBlocks sequentially.
-		for ; syncHeight <= heights.EntryBlock; syncHeight++ {
-			if err := cfg.syncFBlock(ctx, syncHeight, fblocks); err != nil {
+		for ; syncHeight <= tip; syncHeight++ {
+			ts, err := cfg.syncFBlock(ctx, syncHeight,
+				isChainTip(heights, syncHeight), fblocks)
+			if err != nil {
 				return err
 			}
+			poll.observe(ts)
 			select {
-			case <-scanTicker.C:
-				err := heights.Get(ctx, cfg.C)
-				if err != nil {
-					return fmt.Errorf(
-						"factom.Heights.Get(): %v", err)
+			case <-refreshTicker.C:
+				if err := cfg.getHeights(ctx, &heights); err != nil {
+					return err
 				}
-				cfg.syncBar.SetTotal(int64(heights.EntryBlock))
+				tip = cfg.scanTip(heights)
+				cfg.progress.setTip(tip)
 			default:
 			}
 		}
 
-		if synced {
-			// Wait until the next scan tick or we're told to stop.
-			select {
-			case <-scanTicker.C:
-			case <-ctx.Done():
+		// All blocks up to the latest known height have been sent to
+		// the inserter, but we are only synced if factomd is too.
+		if factomdSyncing(heights) {
+			cfg.Log.Debug("waiting for factomd to sync",
+				"directory_block", heights.DirectoryBlock,
+				"leader", heights.Leader)
+			if !waiting {
+				waiting = true
+				cfg.Log.Info("factomd is syncing, waiting...",
+					"directory_block", heights.DirectoryBlock,
+					"leader", heights.Leader)
+			}
+		} else {
+			if waiting {
+				waiting = false
+				cfg.Log.Info("factomd is synced")
+			}
+			if !synced {
+				synced = true
+				cfg.health.setSynced()
+				cfg.progress.setSynced()
+				cfg.Log.Info("fblock scan complete",
+					"height", syncHeight-1)
+			}
+			if cfg.Once {
 				return nil
 			}
 		}
+		if cfg.StopHeight != nil && syncHeight > *cfg.StopHeight {
+			cfg.Log.Info("reached stop height", "height", *cfg.StopHeight)
+			return nil
+		}
+
+		// Wait until the next poll, an external trigger, or we're told
+		// to stop.
+		if !pollTimer.Stop() {
+			select {
+			case <-pollTimer.C:
+			default:
+			}
+		}
+		wait := poll.wait(time.Now())
+		pollTimer.Reset(wait)
+		cfg.Log.Debug("waiting for next block", "wait", wait)
+		select {
+		case <-pollTimer.C:
+		case <-cfg.Trigger:
+			cfg.Log.Debug("poll triggered")
+		case <-ctx.Done():
+			return nil
+		}
 
 		// Check the Factom blockchain height but log and retry if this
 		// request fails.
-		err := heights.Get(ctx, cfg.C)
-		if err != nil {
-			return fmt.Errorf("factom.Heights.Get(): %v", err)
+		if err := cfg.getHeights(ctx, &heights); err != nil {
+			return err
 		}
+		tip = cfg.scanTip(heights)
+		cfg.progress.setTip(tip)
 	}
 }
-func (cfg Config) syncFBlock(ctx context.Context, height uint32,
-	fblocks chan<- fbPrice) error {
+
+// syncFBlock fetches the FBlock at height along with its price and sends it
+// to fblocks. The DBlock timestamp is returned.
+func (cfg Config) syncFBlock(ctx context.Context, height uint32, tip bool,
+	fblocks chan<- fbPrice) (time.Time, error) {
+	if err := cfg.pause.wait(ctx); err != nil {
+		return time.Time{}, err
+	}
 
 	dblk := factom.DBlock{Height: height}
-	if err := dblk.Get(ctx, cfg.C); err != nil {
-		return err
+	c, err := cfg.factomdExcept(ctx, "dblock", nil, func(c *factom.Client) error {
+		return dblk.Get(ctx, c)
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("factom.DBlock.Get(): %w", err)
 	}
 
-	policy := retry.LimitTotal{Limit: 30 * time.Minute,
-		Policy: retry.LimitAttempts{Limit: 200,
-			Policy: retry.Max{Cap: 2 * time.Minute,
-				Policy: retry.Randomize{Factor: .25,
-					Policy: retry.Exponential{
-						Initial:    2 * time.Second,
-						Multiplier: 1.3}}}}}
+	if cfg.CrossValidate {
+		other := factom.DBlock{Height: height}
+		otherC, err := cfg.factomdExcept(ctx, "dblock", c,
+			func(c *factom.Client) error {
+				return other.Get(ctx, c)
+			})
+		if err != nil {
+			return time.Time{}, fmt.Errorf("factom.DBlock.Get(): %w", err)
+		}
+		if *other.FBlock.KeyMR != *dblk.FBlock.KeyMR {
+			return time.Time{}, fmt.Errorf(
+				"FBlock KeyMR mismatch at height %v: %v from %v, but %v from %v",
+				height, dblk.FBlock.KeyMR, c.FactomdServer,
+				other.FBlock.KeyMR, otherC.FactomdServer)
+		}
+	}
 
 	var price float64
-	retry.Run(ctx, policy, nil,
+	err = retry.Run(ctx, cfg.Retry, classify,
 		func(err error, n uint, next time.Duration) {
-			fmt.Printf("Error: %v\n", err)
-			fmt.Printf("%v attempts, next in %v\n", n, next)
+			cfg.metrics.incPriceErrors()
+			cfg.Log.Warn("price lookup failed", "height", height,
+				"err", err, "attempts", n, "next", next)
 		},
 		func() (err error) {
 			// Get price at Timestamp
@@ -153,55 +198,293 @@ func (cfg Config) syncFBlock(ctx context.Context, height uint32,
 			}
 			return nil
 		})
+	if err != nil {
+		if ctx.Err() != nil || cfg.RequirePrice {
+			return time.Time{}, err
+		}
+		cfg.Log.Error("price lookup failed, saving FBlock without a price",
+			"height", height, "err", err)
+		price = 0 // Saved as NULL.
+	}
 
+	// The FBlock is fetched by the KeyMR from the DBlock, and so is
+	// verified when unmarshaled.
 	fb := dblk.FBlock
-	if err := fb.Get(ctx, cfg.C); err != nil {
-		return err
+	if err := cfg.factomd(ctx, "fblock", func(c *factom.Client) error {
+		return fb.Get(ctx, c)
+	}); err != nil {
+		return time.Time{}, fmt.Errorf("factom.FBlock.Get(): %w", err)
+	}
+
+	// If ctx is done, the inserter may have already stopped.
+	select {
+	case fblocks <- fbPrice{fb, price, tip}:
+	case <-ctx.Done():
+		return time.Time{}, ctx.Err()
 	}
 
-	fblocks <- fbPrice{fb, price}
+	return dblk.Timestamp, nil
+}
+
+// walTruncatePages is the size of the WAL, in pages, above which checkpoint
+// waits for readers in order to reset the WAL, so that it does not grow
+// without bound while there are always active readers.
+const walTruncatePages = 16384 // 64 MiB of 4 KiB pages
 
+// checkpoint copies committed pages from the WAL into the database, without
+// blocking readers unless the WAL has grown larger than walTruncatePages.
+func (cfg Config) checkpoint(conn *sqlite.Conn) error {
+	ckpt, err := db.Checkpoint(conn, db.CheckpointPassive)
+	if err != nil {
+		return fmt.Errorf("db.Checkpoint(): %w", err)
+	}
+	if ckpt.Log >= walTruncatePages {
+		cfg.Log.Debug("truncating WAL", "pages", ckpt.Log)
+		ckpt, err = db.Checkpoint(conn, db.CheckpointTruncate)
+		if err != nil {
+			return fmt.Errorf("db.Checkpoint(): %w", err)
+		}
+		if ckpt.Busy {
+			cfg.Log.Warn("WAL checkpoint blocked by readers",
+				"pages", ckpt.Log)
+		}
+	}
+	cfg.metrics.setWALPages(ckpt.Log)
 	return nil
 }
 
+// speedCheckpointHeights is how often, in heights, the database is made
+// durable during an initial sync in speed mode. At most this many FBlocks
+// must be scanned again after an OS crash or power loss.
+const speedCheckpointHeights = 10000
+
+// durableCheckpoint makes all FBlocks up to height durable during speed
+// mode, and returns whether it completed. If readers block the checkpoint,
+// it returns false, and it should be retried after a later commit.
+func (cfg Config) durableCheckpoint(conn *sqlite.Conn,
+	height uint32) (bool, error) {
+	ckpt, err := db.DurableCheckpoint(conn)
+	if err != nil {
+		return false, fmt.Errorf("db.DurableCheckpoint(): %w", err)
+	}
+	if ckpt.Busy {
+		cfg.Log.Warn("durable checkpoint blocked by readers",
+			"height", height)
+		return false, nil
+	}
+	cfg.Log.Info("durable checkpoint", "height", height)
+	cfg.metrics.setWALPages(ckpt.Log)
+	return true, nil
+}
+
 type fbPrice struct {
 	factom.FBlock
 	Price float64
+
+	// Tip is true if this was the latest FBlock on the network at the
+	// time it was fetched, which is never the case while factomd is
+	// syncing.
+	Tip bool
 }
 
+// fblockInserter inserts all fblocks in batches until fblocks is closed.
+// After each batch is committed, it does a non-blocking send on committed.
+//
+// When ctx is done, the scan stops fetching and closes fblocks, and all
+// fblocks already fetched are still inserted and committed. If this takes
+// longer than cfg.ShutdownTimeout, the current batch is committed and any
+// remaining fblocks are discarded.
 func (cfg Config) fblockInserter(ctx context.Context, conn *sqlite.Conn,
-	fblocks <-chan fbPrice) error {
+	fblocks <-chan fbPrice, committed chan<- struct{}) error {
 	conn.SetInterrupt(nil)
+
+	// abort is closed once the ShutdownTimeout has elapsed after ctx
+	// is done.
+	abort := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			return
+		}
+		cfg.Log.Info("saving fetched fblocks before shutdown",
+			"timeout", cfg.ShutdownTimeout)
+		timer := time.NewTimer(cfg.ShutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			close(abort)
+		case <-stop:
+		}
+	}()
+
+	// indexed is set once the indexes have been created after
+	// reaching the chain tip.
+	var indexed bool
+
+	// top is the latest saved height, which determines which FBlocks are
+	// pruned.
+	top, err := db.SelectSyncHeight(conn)
+	if err != nil {
+		return fmt.Errorf("db.SelectSyncHeight(): %w", err)
+	}
+
+	// Webhooks are enqueued for FBlocks from notifyFrom, if not 0, and
+	// for all FBlocks once live is set upon reaching the chain tip.
+	notifyFrom := cfg.WebhooksFrom
+	if notifyFrom == 0 && top > 0 {
+		notifyFrom = top + 1
+	}
+	var live bool
+
+	// speed is set until the end of the initial sync in speed mode.
+	// durable is the latest height known to be safely on disk, and saved
+	// is the latest committed height.
+	speed := cfg.Speed
+	var durable, saved uint32
+	defer func() {
+		if speed && saved > durable {
+			// Make the final commits durable before the
+			// database is closed.
+			if _, err := cfg.durableCheckpoint(conn,
+				saved); err != nil {
+				cfg.Log.Error("durable checkpoint failed",
+					"err", err)
+			}
+		}
+	}()
 	for {
 		// Batch FBlocks in transactions of 100 for improved
-		// performance.
+		// performance, but commit immediately once caught up to the
+		// chain tip.
 		var commit error
+		var start time.Time
+		var height uint32
+		var n int
+		var tip bool
+		var batch []BlockEvent
+		var closed bool
 		release := sqlitex.Save(conn)
-		for i := 0; i < 100; i++ {
+	fill:
+		for ; n < 100 && !tip; n++ {
+			// Commit what we have once paused, rather than
+			// leaving the batch open.
+			var paused <-chan struct{}
+			if n > 0 {
+				paused = cfg.pause.pausedC()
+			}
 			select {
-			case fbp := <-fblocks:
+			case <-paused:
+				break fill
+			case fbp, ok := <-fblocks:
+				if !ok {
+					// The scan is complete.
+					closed = true
+					break fill
+				}
+				if n == 0 {
+					start = time.Now()
+				}
 				if err := db.InsertFBlock(conn, fbp.FBlock, fbp.Price,
-					cfg.Whitelist); err != nil {
+					cfg.Compression, cfg.Whitelist); err != nil {
 					release(&commit)
 					return fmt.Errorf("db.InsertFBlock(): %w", err)
 				}
-			case <-ctx.Done():
+				height = fbp.Height
+				tip = fbp.Tip
+				live = live || tip
+				if live || notifyFrom > 0 && height >= notifyFrom {
+					if err := db.EnqueueWebhooks(conn, height,
+						cfg.Webhooks, cfg.Whitelist); err != nil {
+						release(&commit)
+						return fmt.Errorf("db.EnqueueWebhooks(): %w", err)
+					}
+				}
+				if cfg.Prune {
+					if err := cfg.prune(conn, height,
+						&top); err != nil {
+						release(&commit)
+						return err
+					}
+				}
+				batch = append(batch,
+					newBlockEvent(fbp.FBlock, fbp.Price))
+				cfg.Log.Debug("inserted fblock", "height", height,
+					"txs", len(fbp.Transactions), "price", fbp.Price)
+			case <-abort:
+				// Commit the FBlocks inserted so far.
 				release(&commit)
+				if commit != nil {
+					return commit
+				}
+				cfg.Log.Warn("shutdown timeout exceeded, "+
+					"discarding fetched fblocks",
+					"height", height, "discarded", len(fblocks))
 				return ctx.Err()
 			}
-			cfg.syncBar.Increment()
+		}
+		// done is set once the scan has completed, such as at the
+		// StopHeight, rather than stopped.
+		done := closed && ctx.Err() == nil
+		if (tip || done) && !indexed {
+			// Generate indexes after sync.
+			err := sqlitex.ExecScript(conn,
+				db.CreateIndexFBlockKeyMR+
+					db.CreateIndexTransactionHash)
+			if err != nil {
+				release(&commit)
+				return err
+			}
+			indexed = true
+		}
+		release(&commit)
+		select {
+		case committed <- struct{}{}:
+		default:
+		}
+		for _, e := range batch {
+			cfg.stream.publish(e)
+		}
 
-			if cfg.syncBar.Current() == cfg.syncBar.Total() {
-				// Generate indexes after sync.
-				err := sqlitex.ExecScript(conn,
-					db.CreateIndexFBlockKeyMR+
-						db.CreateIndexTransactionHash)
-				if err != nil {
-					release(&commit)
-					return err
+		if n > 0 {
+			saved = height
+			size, err := db.SelectDBSize(conn)
+			if err != nil {
+				return fmt.Errorf("db.SelectDBSize(): %w", err)
+			}
+			cfg.metrics.observeBatch(height, n, time.Since(start), size)
+			cfg.progress.committed(height, n)
+			cfg.Log.Debug("committed fblock batch", "height", height,
+				"duration", time.Since(start), "db_size", size)
+			if speed {
+				if height >= durable+speedCheckpointHeights {
+					done, err := cfg.durableCheckpoint(conn,
+						height)
+					if err != nil {
+						return err
+					}
+					if done {
+						durable = height
+					}
 				}
+			} else if err := cfg.checkpoint(conn); err != nil {
+				return err
 			}
 		}
-		release(&commit)
+		if speed && (tip || done) {
+			// Foreign keys cannot be enabled within a
+			// transaction.
+			if err := db.EndSpeed(conn); err != nil {
+				return fmt.Errorf("db.EndSpeed(): %w", err)
+			}
+			speed = false
+			cfg.Log.Info("initial sync complete, speed mode disabled",
+				"height", saved)
+		}
+		if closed {
+			return nil
+		}
 	}
 }
@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeFBlocks returns a chain of n FBlocks from height 0, derived from
+// fblockData by rewriting the height and PrevKeyMR.
+func fakeFBlocks(t *testing.T, n int) []fbPrice {
+	fbs := make([]fbPrice, n)
+	var prevKeyMR factom.Bytes32
+	for i := range fbs {
+		data := append(factom.Bytes(nil), fblockData...)
+		copy(data[64:96], prevKeyMR[:])
+		binary.BigEndian.PutUint32(data[136:140], uint32(i))
+		fb := &fbs[i].FBlock
+		require.NoError(t, fb.UnmarshalBinary(data),
+			"factom.FBlock.UnmarshalBinary()")
+		prevKeyMR = *fb.KeyMR
+	}
+	return fbs
+}
+
+func setupInserter(t *testing.T) (Config, *sqlite.Conn) {
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	require.NoError(t, err, "sqlite.OpenConn()")
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(t, db.Setup(conn, false, log.Logger{}), "db.Setup()")
+
+	cfg := New(NewConfig()).cfg
+	cfg.ShutdownTimeout = time.Second
+	return cfg, conn
+}
+
+// TestShutdownDrain stops the engine while fetched FBlocks are still queued
+// and the scan is finishing a request, and checks they are all saved.
+func TestShutdownDrain(t *testing.T) {
+	require := require.New(t)
+	cfg, conn := setupInserter(t)
+
+	fblocks := make(chan fbPrice, 20)
+	for _, fbp := range fakeFBlocks(t, 20) {
+		fblocks <- fbp
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The fake scan closes fblocks once its in flight request returns.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(fblocks)
+	}()
+
+	err := cfg.fblockInserter(ctx, conn, fblocks, make(chan struct{}, 1))
+	require.NoError(err, "all fetched fblocks saved")
+
+	height, err := db.SelectSyncHeight(conn)
+	require.NoError(err)
+	require.EqualValues(19, height)
+	require.EqualValues(19, cfg.progress.get().Height)
+}
+
+// TestShutdownTimeout stops the engine while the scan never closes
+// fblocks, and checks that the FBlocks received are still saved.
+func TestShutdownTimeout(t *testing.T) {
+	require := require.New(t)
+	cfg, conn := setupInserter(t)
+	cfg.ShutdownTimeout = 50 * time.Millisecond
+
+	fblocks := make(chan fbPrice, 20)
+	for _, fbp := range fakeFBlocks(t, 5) {
+		fblocks <- fbp
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	err := cfg.fblockInserter(ctx, conn, fblocks, make(chan struct{}, 1))
+	require.Equal(context.Canceled, err)
+	require.Less(int64(time.Since(start)), int64(time.Second))
+
+	height, err := db.SelectSyncHeight(conn)
+	require.NoError(err)
+	require.EqualValues(4, height)
+}
+
+// TestSpeedScanComplete checks that speed mode ends once a bounded scan
+// completes below the chain tip, but not when the engine is stopped.
+func TestSpeedScanComplete(t *testing.T) {
+	require := require.New(t)
+
+	for _, stopped := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "test.sqlite3")
+		conn, err := sqlite.OpenConn(path, 0)
+		require.NoError(err, "sqlite.OpenConn()")
+		defer conn.Close()
+		require.NoError(db.Setup(conn, true, log.Logger{}), "db.Setup()")
+		cfg := New(NewConfig()).cfg
+		cfg.Speed = true
+
+		fblocks := make(chan fbPrice, 5)
+		for _, fbp := range fakeFBlocks(t, 5) {
+			fblocks <- fbp
+		}
+		close(fblocks)
+		ctx, cancel := context.WithCancel(context.Background())
+		if stopped {
+			cancel()
+		}
+		require.NoError(cfg.fblockInserter(ctx, conn, fblocks,
+			make(chan struct{}, 1)))
+		cancel()
+
+		synchronous, err := sqlitex.ResultInt(
+			conn.Prep(`PRAGMA synchronous;`))
+		require.NoError(err)
+		if stopped {
+			require.Equal(0, synchronous, "still OFF once stopped")
+		} else {
+			require.Equal(1, synchronous, "NORMAL once complete")
+		}
+	}
+}
+
+// TestPrune saves FBlocks in pruned mode, and checks that only the latest
+// PruneKeep FBlocks keep their data.
+func TestPrune(t *testing.T) {
+	require := require.New(t)
+	cfg, conn := setupInserter(t)
+	cfg.Prune = true
+	cfg.PruneKeep = 5
+
+	fblocks := make(chan fbPrice, 20)
+	for _, fbp := range fakeFBlocks(t, 20) {
+		fblocks <- fbp
+	}
+	close(fblocks)
+	require.NoError(cfg.fblockInserter(context.Background(), conn,
+		fblocks, make(chan struct{}, 1)))
+
+	for height := uint32(0); height < 20; height++ {
+		_, err := db.SelectFBlockByHeight(conn, height)
+		if height < 15 {
+			require.True(errors.Is(err, db.ErrPrunedFBlock),
+				"height %v: %v", height, err)
+		} else {
+			require.NoError(err, "height %v", height)
+		}
+	}
+}
+
+// TestWebhooksLive checks that webhooks are only enqueued for new FBlocks,
+// and not for the historical FBlocks of the initial sync.
+func TestWebhooksLive(t *testing.T) {
+	require := require.New(t)
+	cfg, conn := setupInserter(t)
+	cfg.Webhooks = []string{"http://localhost/hook"}
+
+	insert := func(fbs []fbPrice) {
+		fblocks := make(chan fbPrice, len(fbs))
+		for _, fbp := range fbs {
+			fblocks <- fbp
+		}
+		close(fblocks)
+		require.NoError(cfg.fblockInserter(context.Background(), conn,
+			fblocks, make(chan struct{}, 1)))
+	}
+	heights := func() map[uint32]bool {
+		pending, err := db.SelectPendingWebhooks(conn, time.Now(), 1000)
+		require.NoError(err)
+		heights := make(map[uint32]bool)
+		for _, d := range pending {
+			heights[d.Height] = true
+		}
+		return heights
+	}
+
+	// A new database is only notified from the chain tip.
+	fbs := fakeFBlocks(t, 13)
+	fbs[9].Tip = true
+	insert(fbs[:11])
+	require.Equal(map[uint32]bool{9: true, 10: true}, heights())
+
+	// An existing database is notified above its latest saved height.
+	insert(fbs[11:13])
+	require.Equal(map[uint32]bool{9: true, 10: true, 11: true, 12: true},
+		heights())
+}
+
+// fblockData is the 100000th FBlock on Mainnet, shared with the db tests.
+var fblockData = readFBlockData("../db/testdata/fblock-100000.hex")
+
+// readFBlockData returns the FBlock hex encoded in the file at path.
+func readFBlockData(path string) factom.Bytes {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	return factom.NewBytes(string(bytes.TrimSpace(data)))
+}
@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// serve runs an HTTP server on cfg.ListenAddr until ctx is done.
+func (cfg Config) serve(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", cfg.serveMetrics)
+	mux.HandleFunc("/healthz", serveHealthz)
+	mux.HandleFunc("/readyz", cfg.serveReadyz)
+	mux.HandleFunc("/status", cfg.serveStatus)
+	mux.HandleFunc("/stream", cfg.serveStream)
+
+	srv := http.Server{Addr: cfg.ListenAddr, Handler: mux,
+		// Cancel long lived "/stream" requests when ctx is done.
+		BaseContext: func(net.Listener) context.Context { return ctx }}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	// Wait for active requests, which may hold database connections.
+	<-shutdown
+	return nil
+}
@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
+)
+
+// restoreSnapshot restores cfg.Snapshot into the database of conn, if it is
+// empty, after verifying the snapshot. The last FBlock of each scanned range
+// in the snapshot is checked against factomd, which anchors the chain of
+// FBlocks below it.
+func (cfg Config) restoreSnapshot(ctx context.Context, conn *sqlite.Conn) error {
+	empty, err := db.IsEmpty(conn)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		cfg.Log.Warn("ignoring Snapshot for existing database")
+		return nil
+	}
+
+	cfg.Log.Info("verifying snapshot", "path", cfg.Snapshot)
+	snap, err := db.OpenSnapshot(cfg.Snapshot, cfg.Log)
+	if err != nil {
+		return fmt.Errorf("db.OpenSnapshot(): %w", err)
+	}
+	defer snap.Close()
+	if err := snap.Verify(); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+
+	ranges, err := snap.Ranges()
+	if err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		keyMR, err := snap.KeyMR(r.End)
+		if err != nil {
+			return err
+		}
+		dblk := factom.DBlock{Height: r.End}
+		if err := cfg.factomd(ctx, "dblock", func(c *factom.Client) error {
+			return dblk.Get(ctx, c)
+		}); err != nil {
+			return fmt.Errorf("factom.DBlock.Get(): %w", err)
+		}
+		if *dblk.FBlock.KeyMR != keyMR {
+			return fmt.Errorf("invalid snapshot: "+
+				"FBlock KeyMR mismatch at height %v: %v, but %v from factomd",
+				r.End, keyMR, dblk.FBlock.KeyMR)
+		}
+	}
+
+	if err := snap.Restore(conn); err != nil {
+		return fmt.Errorf("db.Snapshot.Restore(): %w", err)
+	}
+	m := snap.Manifest
+	cfg.Log.Info("restored snapshot", "sync_height", m.SyncHeight,
+		"created", m.Created)
+	return nil
+}
@@ -0,0 +1,367 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"crawshaw.io/sqlite"
+	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
+)
+
+// BlockEvent summarizes a committed FBlock and its Transactions. It is sent
+// as the data of each "fblock" event on the "/stream" endpoint.
+type BlockEvent struct {
+	Height       uint32    `json:"height"`
+	KeyMR        string    `json:"key_mr"`
+	Timestamp    int64     `json:"timestamp"`
+	Price        float64   `json:"price,omitempty"` // USD
+	Transactions []TxEvent `json:"transactions"`
+}
+
+// TxEvent summarizes a Transaction within a BlockEvent.
+type TxEvent struct {
+	TxID      string          `json:"tx_id"`
+	Timestamp int64           `json:"timestamp"`
+	Inputs    []AddressAmount `json:"inputs"`
+	Outputs   []AddressAmount `json:"outputs"`
+	ECOutputs []AddressAmount `json:"ec_outputs"`
+}
+
+// AddressAmount is an amount, in factoshis, sent from or to Address.
+type AddressAmount struct {
+	Address string `json:"address"`
+	Amount  uint64 `json:"amount"`
+}
+
+func newBlockEvent(fb factom.FBlock, price float64) BlockEvent {
+	e := BlockEvent{
+		Height:       fb.Height,
+		KeyMR:        fb.KeyMR.String(),
+		Timestamp:    fb.Timestamp.Unix(),
+		Price:        price,
+		Transactions: make([]TxEvent, len(fb.Transactions)),
+	}
+	for i, tx := range fb.Transactions {
+		txe := &e.Transactions[i]
+		txe.TxID = tx.ID.String()
+		txe.Timestamp = tx.Timestamp.Unix()
+		for _, adr := range tx.FCTInputs {
+			txe.Inputs = append(txe.Inputs, AddressAmount{
+				adr.FAAddress().String(), adr.Amount})
+		}
+		for _, adr := range tx.FCTOutputs {
+			txe.Outputs = append(txe.Outputs, AddressAmount{
+				adr.FAAddress().String(), adr.Amount})
+		}
+		for _, adr := range tx.ECOutputs {
+			txe.ECOutputs = append(txe.ECOutputs, AddressAmount{
+				adr.ECAddress().String(), adr.Amount})
+		}
+	}
+	return e
+}
+
+// filter returns a copy of e with only the Transactions involving one of
+// the addresses. If addresses is empty, e is returned unchanged. The
+// returned bool is false if no Transactions remain.
+func (e BlockEvent) filter(addresses map[string]struct{}) (BlockEvent, bool) {
+	if len(addresses) == 0 {
+		return e, true
+	}
+	txs := e.Transactions
+	e.Transactions = nil
+	for _, tx := range txs {
+		if tx.involves(addresses) {
+			e.Transactions = append(e.Transactions, tx)
+		}
+	}
+	return e, len(e.Transactions) > 0
+}
+
+func (tx TxEvent) involves(addresses map[string]struct{}) bool {
+	for _, adrs := range [][]AddressAmount{tx.Inputs, tx.Outputs, tx.ECOutputs} {
+		for _, adr := range adrs {
+			if _, ok := addresses[adr.Address]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// streamBufferSize is the number of BlockEvents that may be queued for a
+// subscriber before it is considered too slow and is disconnected.
+const streamBufferSize = 100
+
+// broadcaster fans out BlockEvents to all subscribers.
+type broadcaster struct {
+	sync.Mutex
+	subs map[chan BlockEvent]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: make(map[chan BlockEvent]struct{})}
+}
+
+func (b *broadcaster) subscribe() chan BlockEvent {
+	b.Lock()
+	defer b.Unlock()
+	sub := make(chan BlockEvent, streamBufferSize)
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *broadcaster) unsubscribe(sub chan BlockEvent) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub)
+	}
+}
+
+// publish sends e to all subscribers. Subscribers which are not keeping up
+// are closed, and must reconnect and resume from their last height.
+func (b *broadcaster) publish(e BlockEvent) {
+	b.Lock()
+	defer b.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// serveStream streams a BlockEvent for each committed FBlock using
+// Server-Sent Events.
+//
+// The "address" query parameter is a comma separated list of FA or EC
+// addresses which limits the events to Transactions involving those
+// addresses.
+//
+// The "from" query parameter, or the Last-Event-ID header, resumes the stream
+// from the given height by first sending all events for saved FBlocks
+// starting at that height. The "id" of each event is its height, so clients
+// reconnecting with Last-Event-ID do not miss any events.
+func (cfg Config) serveStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	addresses, err := parseAddresses(r.URL.Query().Get("address"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resume bool
+	var from uint32
+	fromStr := r.URL.Query().Get("from")
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID != "" {
+		fromStr = lastID
+	}
+	if fromStr != "" {
+		f, err := strconv.ParseUint(fromStr, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid from height", http.StatusBadRequest)
+			return
+		}
+		from = uint32(f)
+		if lastID != "" {
+			// Resume after the last event received.
+			from++
+		}
+		resume = true
+	}
+
+	// Subscribe before reading any saved FBlocks so that no events are
+	// missed in between.
+	sub := cfg.stream.subscribe()
+	defer cfg.stream.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(e BlockEvent) error {
+		e, ok := e.filter(addresses)
+		if !ok {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %v\nevent: fblock\ndata: %s\n\n",
+			e.Height, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if resume {
+		next, err := cfg.sendSavedBlocks(r, from, send)
+		if err != nil {
+			cfg.Log.Warn("stream", "err", err)
+			return
+		}
+		from = next
+	}
+
+	for {
+		select {
+		case e, ok := <-sub:
+			if !ok {
+				// The subscriber fell behind.
+				return
+			}
+			if resume && e.Height < from {
+				// Already sent from the database.
+				continue
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// streamChunkSize is the number of saved FBlocks read with each read-only
+// connection when replaying "/stream", so that a slow client does not hold
+// a connection from the pool.
+const streamChunkSize = 100
+
+// sendSavedBlocks calls send with a BlockEvent for each saved FBlock starting
+// at from. It returns the height after the last FBlock sent.
+func (cfg Config) sendSavedBlocks(r *http.Request, from uint32,
+	send func(BlockEvent) error) (uint32, error) {
+	ctx := r.Context()
+
+	// Unscanned heights are skipped.
+	var ranges []db.Range
+	if err := cfg.withReader(ctx, func(conn *sqlite.Conn) (err error) {
+		ranges, err = db.SelectScannedRanges(conn)
+		return
+	}); err != nil {
+		return from, err
+	}
+	next := from
+	for _, rng := range ranges {
+		start := rng.Start
+		if start < next {
+			start = next
+		}
+		for height := int64(start); height <= int64(rng.End); {
+			end := height + streamChunkSize - 1
+			if end > int64(rng.End) {
+				end = int64(rng.End)
+			}
+			events, err := cfg.selectBlockEvents(ctx,
+				uint32(height), uint32(end))
+			height = end + 1
+			if err != nil {
+				return next, err
+			}
+			for _, e := range events {
+				if err := send(e); err != nil {
+					return next, err
+				}
+				next = e.Height + 1
+			}
+		}
+	}
+	return next, nil
+}
+
+// selectBlockEvents returns a BlockEvent for each saved FBlock from height
+// from to to, inclusive. Pruned FBlocks are fetched from factomd after the
+// read-only connection is returned to the pool.
+func (cfg Config) selectBlockEvents(ctx context.Context,
+	from, to uint32) ([]BlockEvent, error) {
+	fbs := make([]factom.FBlock, 0, to-from+1)
+	prices := make([]float64, 0, to-from+1)
+	pruned := make(map[int]bool)
+	if err := cfg.withReader(ctx, func(conn *sqlite.Conn) error {
+		for height := int64(from); height <= int64(to); height++ {
+			fb, err := db.SelectFBlockByHeight(conn, uint32(height))
+			if errors.Is(err, db.ErrPrunedFBlock) {
+				pruned[len(fbs)], err = true, nil
+			}
+			if err != nil {
+				return fmt.Errorf("db.SelectFBlockByHeight(%v): %w",
+					height, err)
+			}
+			price, err := db.SelectFBlockPrice(conn, uint32(height))
+			if err != nil {
+				return fmt.Errorf("db.SelectFBlockPrice(%v): %w",
+					height, err)
+			}
+			fbs = append(fbs, fb)
+			prices = append(prices, price)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	events := make([]BlockEvent, len(fbs))
+	for i, fb := range fbs {
+		if pruned[i] {
+			var err error
+			if fb, err = cfg.fetchPrunedFBlock(ctx, fb); err != nil {
+				return nil, fmt.Errorf(
+					"fetch pruned FBlock %v: %w", fb.Height, err)
+			}
+		}
+		events[i] = newBlockEvent(fb, prices[i])
+	}
+	return events, nil
+}
+
+// withReader calls fn with a read-only connection from the pool, which is
+// returned to the pool once fn returns.
+func (cfg Config) withReader(ctx context.Context,
+	fn func(*sqlite.Conn) error) error {
+	conn := cfg.readers.Get(ctx)
+	if conn == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("database closed")
+	}
+	defer cfg.readers.Put(conn)
+	return fn(conn)
+}
+
+func parseAddresses(adrsStr string) (map[string]struct{}, error) {
+	if adrsStr == "" {
+		return nil, nil
+	}
+	addresses := make(map[string]struct{})
+	for _, adrStr := range strings.Split(adrsStr, ",") {
+		var fa factom.FAAddress
+		var ec factom.ECAddress
+		if fa.Set(adrStr) != nil && ec.Set(adrStr) != nil {
+			return nil, fmt.Errorf("invalid address: %q", adrStr)
+		}
+		addresses[adrStr] = struct{}{}
+	}
+	return addresses, nil
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSendSavedBlocks replays more than one chunk of saved FBlocks with a
+// single read-only connection, which must not be held while sending.
+func TestSendSavedBlocks(t *testing.T) {
+	require := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "test.sqlite3")
+	conn, err := sqlite.OpenConn(path, 0)
+	require.NoError(err, "sqlite.OpenConn()")
+	defer conn.Close()
+	require.NoError(db.Setup(conn, false, log.Logger{}), "db.Setup()")
+	fbs := fakeFBlocks(t, streamChunkSize+10)
+	for _, fbp := range fbs {
+		require.NoError(db.InsertFBlock(conn, fbp.FBlock, 1,
+			db.CompressionNone, nil), "db.InsertFBlock()")
+	}
+
+	cfg := NewConfig()
+	cfg.readers, err = db.OpenReadPool(path, 1)
+	require.NoError(err, "db.OpenReadPool()")
+	defer cfg.readers.Close()
+
+	var heights []uint32
+	r := httptest.NewRequest("GET", "/stream", nil)
+	next, err := cfg.sendSavedBlocks(r, 5, func(e BlockEvent) error {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Second)
+		defer cancel()
+		conn := cfg.readers.Get(ctx)
+		require.NotNil(conn, "read connection held while sending")
+		cfg.readers.Put(conn)
+
+		require.Equal(fbs[e.Height].KeyMR.String(), e.KeyMR)
+		heights = append(heights, e.Height)
+		return nil
+	})
+	require.NoError(err, "sendSavedBlocks()")
+	require.EqualValues(len(fbs), next)
+	require.Len(heights, len(fbs)-5)
+	require.EqualValues(5, heights[0])
+}
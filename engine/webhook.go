@@ -0,0 +1,153 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"github.com/canonical-ledgers/fblock-scan/db"
+)
+
+// WebhookEvent is the JSON body POSTed to each webhook URL when a tracked
+// address sends or receives FCT.
+type WebhookEvent struct {
+	TxID      string `json:"tx_id"`
+	Height    uint32 `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Address   string `json:"address"`
+	Amount    int64  `json:"amount"` // factoshis, negative if sent
+}
+
+const (
+	webhookPollInterval = 30 * time.Second
+	webhookTimeout      = 30 * time.Second
+	webhookMaxBackoff   = time.Hour
+)
+
+// webhookIDHeader is the header of each webhook POST which holds the id of
+// the delivery. It is the same for every attempt of a delivery, so receivers
+// can use it to discard duplicates.
+const webhookIDHeader = "Idempotency-Key"
+
+// notifyWebhooks delivers all pending webhook notifications from the
+// "webhook_delivery" queue. It runs until ctx is done, waking up on each
+// receive from committed or every webhookPollInterval.
+//
+// Failed deliveries are retried with exponential backoff. Since the queue is
+// persisted, pending notifications survive restarts. Delivery is at least
+// once: a delivery is only marked after its POST succeeds, so it is POSTed
+// again if the mark fails or the process stops in between.
+func (cfg Config) notifyWebhooks(ctx context.Context,
+	committed <-chan struct{}) error {
+
+	conn, err := sqlite.OpenConn(cfg.DBURI, 0)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetInterrupt(ctx.Done())
+	conn.SetBusyTimeout(writeBusyTimeout)
+	// Only the inserter checkpoints, since none may run in speed mode.
+	if err := db.SetAutoCheckpoint(conn, 0); err != nil {
+		return fmt.Errorf("db.SetAutoCheckpoint(): %w", err)
+	}
+
+	client := http.Client{Timeout: webhookTimeout}
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := cfg.deliverWebhooks(ctx, conn, &client); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// The inserter may be holding the write lock, so just
+			// try again later.
+			cfg.Log.Warn("webhook delivery", "err", err)
+		}
+		select {
+		case <-committed:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (cfg Config) deliverWebhooks(ctx context.Context, conn *sqlite.Conn,
+	client *http.Client) error {
+	for {
+		deliveries, err := db.SelectPendingWebhooks(conn, time.Now(), 100)
+		if err != nil {
+			return fmt.Errorf("db.SelectPendingWebhooks(): %w", err)
+		}
+		if len(deliveries) == 0 {
+			return nil
+		}
+		for _, d := range deliveries {
+			if err := postWebhook(ctx, client, d); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				backoff := webhookMaxBackoff
+				if d.Attempts < 12 {
+					backoff = (5 * time.Second) << uint(d.Attempts)
+				}
+				if backoff > webhookMaxBackoff {
+					backoff = webhookMaxBackoff
+				}
+				cfg.Log.Warn("webhook failed", "url", d.URL,
+					"tx_id", d.TxID, "address", d.Address,
+					"attempts", d.Attempts+1, "next", backoff,
+					"err", err)
+				if err := db.MarkWebhookFailed(conn, d.ID,
+					time.Now().Add(backoff)); err != nil {
+					return fmt.Errorf("db.MarkWebhookFailed(): %w",
+						err)
+				}
+				continue
+			}
+			cfg.Log.Debug("webhook delivered", "url", d.URL,
+				"tx_id", d.TxID, "address", d.Address)
+			if err := db.MarkWebhookDelivered(conn, d.ID,
+				time.Now()); err != nil {
+				return fmt.Errorf("db.MarkWebhookDelivered(): %w", err)
+			}
+		}
+	}
+}
+
+func postWebhook(ctx context.Context, client *http.Client,
+	d db.WebhookDelivery) error {
+	body, err := json.Marshal(WebhookEvent{
+		TxID:      d.TxID.String(),
+		Height:    d.Height,
+		Timestamp: d.Timestamp.Unix(),
+		Address:   d.Address,
+		Amount:    d.Amount,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookIDHeader, strconv.FormatInt(d.ID, 10))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %v", res.Status)
+	}
+	return nil
+}
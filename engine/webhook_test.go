@@ -0,0 +1,37 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/canonical-ledgers/fblock-scan/db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostWebhook(t *testing.T) {
+	require := require.New(t)
+
+	var keys []string
+	var event WebhookEvent
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			keys = append(keys, r.Header.Get(webhookIDHeader))
+			require.NoError(json.NewDecoder(r.Body).Decode(&event))
+		}))
+	defer srv.Close()
+
+	d := db.WebhookDelivery{ID: 7, URL: srv.URL, Height: 10,
+		Timestamp: time.Unix(1582221851, 0), Address: "FA", Amount: -1}
+	client := http.Client{Timeout: time.Second}
+	require.NoError(postWebhook(context.Background(), &client, d))
+	d.Attempts++
+	require.NoError(postWebhook(context.Background(), &client, d))
+
+	require.Equal([]string{"7", "7"}, keys, "same key for each attempt")
+	require.Equal(WebhookEvent{TxID: d.TxID.String(), Height: 10,
+		Timestamp: 1582221851, Address: "FA", Amount: -1}, event)
+}
@@ -2,27 +2,147 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/Factom-Asset-Tokens/factom"
+	"github.com/canonical-ledgers/fblock-scan/db"
 	"github.com/canonical-ledgers/fblock-scan/engine"
+	"github.com/canonical-ledgers/fblock-scan/log"
+	"github.com/mattn/go-isatty"
 )
 
-func parseFlags(cfg *engine.Config) {
-	homeDir, _ := os.UserHomeDir()
-	flag.StringVar(&cfg.DBURI, "db", homeDir+"/fblock-scan.sqlite3",
-		"SQLite Database URI")
-	flag.StringVar(&cfg.C.FactomdServer, "s", cfg.C.FactomdServer, "Factomd URL")
+// parseFlags populates cfg from the command line flags and returns whether
+// to render a progress bar.
+func parseFlags(cfg *engine.Config) (progressBar bool) {
+	flag.StringVar(&cfg.DBURI, "db", defaultDBURI(), "SQLite Database URI")
+	factomd := flag.String("s", strings.Join(cfg.Factomd, ","), "Factomd URLs (comma separated list)")
+	flag.BoolVar(&cfg.CrossValidate, "cross-validate", false, "Refuse to insert an FBlock unless two factomd endpoints agree on its KeyMR")
 	flag.StringVar(&cfg.Price.APIKey, "api-key", "", "CryptoCompare API Key")
 	flag.Var((*Whitelist)(&cfg.Whitelist), "whitelist", "Track only these addresses (comma separated list)")
+	flag.Var((*URLs)(&cfg.Webhooks), "webhook", "POST tracked address activity to these URLs (comma separated list)")
+	webhookFrom := flag.Uint("webhook-from", 0, "Also POST activity in historical blocks from this height, instead of only in new blocks")
 	start := flag.Int64("start-scan", 0, "Start scanning from this height if creating a new database")
+	from := flag.Int64("from", 0, "Scan the unscanned heights from this height up to -to, or the chain tip, also of an existing database")
+	flag.BoolVar(&cfg.AutoStart, "auto-start", false, "Start a new whitelist database at the first block using a whitelisted address")
+	stop := flag.Int64("to", 0, "Stop after scanning this height")
+	flag.StringVar(&cfg.Snapshot, "snapshot", "", "Verify and restore a new database from this snapshot file")
+	flag.BoolVar(&cfg.Backfill, "backfill", false, "Scan unscanned heights from -start-scan up to the latest saved block of an existing database")
+	flag.BoolVar(&cfg.Once, "once", false, "Stop after syncing to the current chain tip")
 	flag.BoolVar(&cfg.Debug, "debug", false, "Print additional debug info")
-	flag.BoolVar(&cfg.Speed, "speed", false, "Improve insert speed at the risk of database corruption on crashes")
+	var logFormat log.Format
+	flag.Var(&logFormat, "log-format", "Log format: logfmt or json")
+	daemon := flag.Bool("daemon", false, "Run as a service: disable the progress bar and serve /healthz and /readyz on -listen (default localhost:8077)")
+	noProgress := flag.Bool("no-progress", false, "Disable the progress bar even when stdout is a terminal")
+	flag.DurationVar(&cfg.RefreshInterval, "refresh-interval", cfg.RefreshInterval, "Refresh the chain height this often during a sync")
+	flag.DurationVar(&cfg.PollInterval, "poll-interval", cfg.PollInterval, "Check for a new block this often once synced")
+	flag.BoolVar(&cfg.AdaptivePolling, "adaptive-polling", cfg.AdaptivePolling, "Wait until the next block is expected before polling every -poll-interval")
+	retryAttempts := flag.Uint("retry-attempts", 200, "Give up on a failed factomd or price API request after this many attempts")
+	retryTimeout := flag.Duration("retry-timeout", 30*time.Minute, "Give up on a failed factomd or price API request after this long")
+	flag.BoolVar(&cfg.RequirePrice, "require-price", false, "Stop if the price of an FBlock cannot be determined, instead of saving it without a price")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "On SIGINT, keep saving already fetched blocks for up to this long")
+	flag.DurationVar(&cfg.BackupInterval, "backup-interval", 0, "Write a backup to -backup-path this often (e.g. 24h)")
+	flag.StringVar(&cfg.BackupPath, "backup-path", "", "Backup file path, replaced by each backup")
+	flag.BoolVar(&cfg.BackupSnapshot, "backup-snapshot", false, "Write each backup as a compressed snapshot with a manifest")
+	compress := flag.Bool("compress", false, "Compress the data of new blocks, see also: fblock-scan db compress")
+	flag.BoolVar(&cfg.Prune, "prune", false, "Discard the raw data of old blocks, keeping balances and transaction ledgers")
+	pruneKeep := flag.Uint("prune-keep", 0, "With -prune, keep the raw data of this many of the latest blocks")
+	flag.IntVar(&cfg.ReadPoolSize, "read-pool-size", cfg.ReadPoolSize, "Number of read-only database connections for the HTTP server")
+	flag.StringVar(&cfg.ListenAddr, "listen", "", "Serve metrics and health checks over HTTP on this address (e.g. localhost:8077)")
+	flag.BoolVar(&cfg.Speed, "speed", false, "Improve insert speed during the initial sync, at the risk of rescanning up to 10000 blocks after an OS crash")
 
 	flag.Parse()
 
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
 	cfg.StartScanHeight = uint32(*start)
+	if set["from"] {
+		if set["start-scan"] || cfg.Backfill {
+			fmt.Fprintln(flag.CommandLine.Output(),
+				"-from cannot be used with -start-scan or -backfill")
+			flag.Usage()
+			os.Exit(2)
+		}
+		cfg.StartScanHeight = uint32(*from)
+		cfg.ScanRange = true
+	}
+	if set["to"] {
+		stopHeight := uint32(*stop)
+		cfg.StopHeight = &stopHeight
+		if stopHeight < cfg.StartScanHeight {
+			fmt.Fprintln(flag.CommandLine.Output(),
+				"-to must not be less than -from or -start-scan")
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	if cfg.AutoStart && len(cfg.Whitelist) == 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "-auto-start requires -whitelist")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg.Factomd = nil
+	if err := (*URLs)(&cfg.Factomd).Set(*factomd); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), "invalid -s:", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if cfg.BackupInterval > 0 && cfg.BackupPath == "" {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-backup-interval requires -backup-path")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if cfg.ReadPoolSize < 1 {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-read-pool-size must be at least 1")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if cfg.RefreshInterval <= 0 || cfg.PollInterval <= 0 {
+		fmt.Fprintln(flag.CommandLine.Output(),
+			"-refresh-interval and -poll-interval must be positive")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg.PruneKeep = uint32(*pruneKeep)
+	cfg.WebhooksFrom = uint32(*webhookFrom)
+
+	if *compress {
+		cfg.Compression = db.CompressionDeflate
+	}
+
+	cfg.Retry = engine.NewRetryPolicy(*retryAttempts, *retryTimeout)
+
+	level := log.LevelInfo
+	if cfg.Debug {
+		level = log.LevelDebug
+	}
+	cfg.Log = log.New(os.Stderr, logFormat, level)
+	progressBar = !*noProgress && isatty.IsTerminal(os.Stdout.Fd())
+
+	if *daemon {
+		progressBar = false
+		if cfg.ListenAddr == "" {
+			cfg.ListenAddr = "localhost:8077"
+		}
+	}
+	return
+}
+
+func defaultDBURI() string {
+	homeDir, _ := os.UserHomeDir()
+	return homeDir + "/fblock-scan.sqlite3"
 }
 
 type Whitelist map[factom.FAAddress]struct{}
@@ -52,3 +172,23 @@ func (wl *Whitelist) Set(adrStr string) error {
 	}
 	return nil
 }
+
+type URLs []string
+
+func (urls URLs) String() string {
+	return strings.Join(urls, ",")
+}
+
+func (urls *URLs) Set(urlStr string) error {
+	for _, urlStr := range strings.Split(urlStr, ",") {
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid URL scheme: %q", urlStr)
+		}
+		*urls = append(*urls, urlStr)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	crawshaw.io/sqlite v0.2.5
+	github.com/AdamSLevy/jsonrpc2/v13 v13.0.1
 	github.com/AdamSLevy/retry v0.0.0-20191017184328-cce921f261f4
 	github.com/Factom-Asset-Tokens/base58 v0.0.0-20191118025050-4fa02e92ec20 // indirect
 	github.com/Factom-Asset-Tokens/factom v0.0.0-20200212221606-6d5a0a1efb17
@@ -11,7 +12,7 @@ require (
 	github.com/cheggaaa/pb/v3 v3.0.4
 	github.com/fatih/color v1.9.0 // indirect
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/mattn/go-isatty v0.0.12 // indirect
+	github.com/mattn/go-isatty v0.0.12
 	github.com/mattn/go-runewidth v0.0.8 // indirect
 	github.com/stretchr/testify v1.4.0
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
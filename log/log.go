@@ -0,0 +1,181 @@
+// Package log implements a minimal leveled, structured logger which writes
+// either logfmt or JSON lines.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (lvl Level) String() string {
+	switch lvl {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(lvl)) + ")"
+}
+
+// Format is the encoding used for each log line.
+type Format int
+
+const (
+	FormatLogfmt Format = iota
+	FormatJSON
+)
+
+// Set implements flag.Value.
+func (f *Format) Set(s string) error {
+	switch s {
+	case "logfmt", "text":
+		*f = FormatLogfmt
+	case "json":
+		*f = FormatJSON
+	default:
+		return fmt.Errorf("invalid log format %q, expected logfmt or json", s)
+	}
+	return nil
+}
+
+func (f Format) String() string {
+	if f == FormatJSON {
+		return "json"
+	}
+	return "logfmt"
+}
+
+// Logger writes structured log lines of at least Level to an io.Writer.
+//
+// The zero value discards all messages. Loggers may be copied and used
+// concurrently.
+type Logger struct {
+	w      *syncWriter
+	format Format
+	level  Level
+	fields []interface{}
+}
+
+type syncWriter struct {
+	sync.Mutex
+	io.Writer
+}
+
+// New returns a Logger that writes messages of at least level to w.
+func New(w io.Writer, format Format, level Level) Logger {
+	return Logger{w: &syncWriter{Writer: w}, format: format, level: level}
+}
+
+// With returns a copy of l which includes the given key value pairs in every
+// message.
+func (l Logger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	l.fields = append(append(fields, l.fields...), kv...)
+	return l
+}
+
+// Enabled returns true if messages at lvl are written.
+func (l Logger) Enabled(lvl Level) bool {
+	return l.w != nil && lvl >= l.level
+}
+
+func (l Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+func (l Logger) Info(msg string, kv ...interface{})  { l.Log(LevelInfo, msg, kv...) }
+func (l Logger) Warn(msg string, kv ...interface{})  { l.Log(LevelWarn, msg, kv...) }
+func (l Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Log writes msg at lvl along with the key value pairs in kv. Keys should be
+// strings. A trailing key without a value is logged with a nil value.
+func (l Logger) Log(lvl Level, msg string, kv ...interface{}) {
+	if !l.Enabled(lvl) {
+		return
+	}
+
+	kv = append([]interface{}{
+		"time", time.Now().UTC().Format(time.RFC3339Nano),
+		"level", lvl,
+		"msg", msg,
+	}, append(l.fields[:len(l.fields):len(l.fields)], kv...)...)
+
+	var line []byte
+	if l.format == FormatJSON {
+		line = encodeJSON(kv)
+	} else {
+		line = encodeLogfmt(kv)
+	}
+
+	l.w.Lock()
+	defer l.w.Unlock()
+	l.w.Write(line)
+}
+
+func encodeLogfmt(kv []interface{}) []byte {
+	var line []byte
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			line = append(line, ' ')
+		}
+		line = append(line, fmt.Sprint(kv[i])...)
+		line = append(line, '=')
+		line = append(line, logfmtValue(value(kv, i+1))...)
+	}
+	return append(line, '\n')
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func encodeJSON(kv []interface{}) []byte {
+	line := []byte{'{'}
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			line = append(line, ',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(kv[i]))
+		line = append(line, key...)
+		line = append(line, ':')
+
+		v := value(kv, i+1)
+		switch v.(type) {
+		case error, fmt.Stringer:
+			v = fmt.Sprint(v)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(v))
+		}
+		line = append(line, data...)
+	}
+	return append(line, '}', '\n')
+}
+
+func value(kv []interface{}, i int) interface{} {
+	if i < len(kv) {
+		return kv[i]
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	l := New(&buf, FormatLogfmt, LevelInfo).With("component", "test")
+
+	l.Debug("hidden")
+	require.Empty(buf.String(), "Debug below Level")
+
+	l.Info("hello world", "height", 5, "err", fmt.Errorf("a=b"))
+	line := buf.String()
+	require.True(strings.HasSuffix(line,
+		` level=info msg="hello world" component=test height=5 err="a=b"`+"\n"),
+		line)
+
+	buf.Reset()
+	l = New(&buf, FormatJSON, LevelDebug)
+	l.Debug("json", "height", 5, "level2")
+	var m map[string]interface{}
+	require.NoError(json.Unmarshal(buf.Bytes(), &m))
+	require.Equal("debug", m["level"])
+	require.Equal("json", m["msg"])
+	require.Equal(float64(5), m["height"])
+	require.Contains(m, "level2")
+
+	// The zero value discards everything.
+	Logger{}.Error("discarded")
+}
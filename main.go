@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/canonical-ledgers/fblock-scan/engine"
 )
@@ -13,12 +13,38 @@ func main() {
 	os.Exit(_main())
 }
 func _main() int {
+	if len(os.Args) > 1 && os.Args[1] == "db" {
+		return dbCommand(os.Args[2:])
+	}
+
 	cfg := engine.NewConfig()
-	parseFlags(&cfg)
+	if parseFlags(&cfg) {
+		bar := newProgressBar()
+		defer bar.finish()
+		cfg.OnProgress = bar.update
+	}
 
-	fmt.Println("fblock-scan: Factoid Block Transaction Scanner")
-	fmt.Println(cfg)
-	fmt.Println("Starting...")
+	tracking := Whitelist(cfg.Whitelist).String()
+	if tracking == "" {
+		tracking = "all"
+	}
+	cfg.Log.Info("fblock-scan: Factoid Block Transaction Scanner")
+	cfg.Log.Info("starting", "factomd", URLs(cfg.Factomd).String(),
+		"db", cfg.DBURI, "tracking", tracking)
+
+	// SIGUSR1 triggers an immediate check for a new block.
+	trigger := make(chan struct{}, 1)
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		for range sigusr1 {
+			select {
+			case trigger <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	cfg.Trigger = trigger
 
 	// Listen for an Interrupt and cancel everything if it occurs.
 	ctx, cancel := context.WithCancel(context.Background())
@@ -29,32 +55,36 @@ func _main() int {
 		cancel()
 	}()
 
-	engineDone, err := cfg.Start(ctx)
-	if err != nil {
-		fmt.Println("Error: ", err)
+	e := engine.New(cfg)
+	if err := e.Start(ctx); err != nil {
+		cfg.Log.Error("engine failed to start", "err", err)
 		return 1
 	}
-	defer func() {
-		<-engineDone
-		fmt.Println("Engine stopped.")
-	}()
+	cfg.Log.Info("engine started")
 
-	fmt.Println("Engine started.")
+	var interrupted bool
+	select {
+	case <-ctx.Done():
+		interrupted = true
+		cfg.Log.Info("SIGINT: shutting down...")
+	case <-e.Done():
+	}
 
-	defer func() {
-		// Stop handling all signals so a force quit can occur with a
-		// second sigint.
-		signal.Reset()
+	// Stop handling all signals so a force quit can occur with a second
+	// sigint while the fetched blocks are saved.
+	signal.Reset()
 
-		// Cause our sigint listener goroutine to call cancel().
-		close(sigint)
-	}()
+	// Cause our sigint listener goroutine to call cancel().
+	close(sigint)
 
-	select {
-	case <-ctx.Done():
-		fmt.Println("SIGINT: Shutting down...")
-		return 0
-	case <-engineDone:
+	err := e.Wait()
+	cfg.Log.Info("engine stopped")
+	if err != nil {
+		cfg.Log.Error("engine failed", "err", err)
+		return 1
+	}
+	if !interrupted {
+		cfg.Log.Info("scan complete")
 	}
-	return 1
+	return 0
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/canonical-ledgers/fblock-scan/engine"
+	"github.com/cheggaaa/pb/v3"
+)
+
+// progressBar renders each engine.SyncStatus to the terminal until the
+// first sync is complete.
+type progressBar struct {
+	sync.Mutex
+	bar               *pb.ProgressBar
+	started, finished bool
+}
+
+func newProgressBar() *progressBar {
+	return &progressBar{bar: pb.New64(0)}
+}
+
+func (p *progressBar) update(status engine.SyncStatus) {
+	p.Lock()
+	defer p.Unlock()
+	if p.finished {
+		return
+	}
+	p.bar.SetTotal(status.Total)
+	p.bar.SetCurrent(status.Done)
+	if !p.started {
+		p.started = true
+		p.bar.Start()
+	}
+	if status.Synced {
+		p.finishLocked()
+	}
+}
+
+func (p *progressBar) finish() {
+	p.Lock()
+	defer p.Unlock()
+	p.finishLocked()
+}
+
+func (p *progressBar) finishLocked() {
+	if p.started && !p.finished {
+		p.bar.Finish()
+	}
+	p.finished = true
+}